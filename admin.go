@@ -0,0 +1,158 @@
+package cache
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultAdminPageSize = 100
+
+// adminVariant describes one of the entries stored for a key
+type adminVariant struct {
+	Vary        http.Header `json:"vary"`
+	Status      int         `json:"status"`
+	Size        int64       `json:"size"`
+	Public      bool        `json:"public"`
+	Expiration  time.Time   `json:"expiration"`
+	StoredUntil time.Time   `json:"stored_until"`
+	Age         int64       `json:"age"`
+	Hits        uint64      `json:"hits"`
+	Tags        []string    `json:"tags,omitempty"`
+	Headers     http.Header `json:"headers,omitempty"`
+}
+
+// adminEntry groups the variants stored for a key
+type adminEntry struct {
+	Key      string         `json:"key"`
+	Variants []adminVariant `json:"variants"`
+}
+
+// adminPage is a page of entries, NextCursor is the bucket where the next page starts
+type adminPage struct {
+	Entries    []adminEntry `json:"entries"`
+	NextCursor *int         `json:"next_cursor"`
+}
+
+// canAdmin returns if the client is allowed to inspect the cache
+func (handler *Handler) canAdmin(r *http.Request) bool {
+	config := handler.Config
+	return isAuthorized(r, config.AdminAllow, config.AdminSecretHeader, config.AdminSecret)
+}
+
+// serveAdmin responds with the stored entries in JSON. With the key parameter
+// it returns the variants of that key including their headers. Otherwise
+// it lists the entries which keys start with the prefix parameter, starting
+// at the bucket in the cursor parameter and stopping after the bucket
+// where the limit parameter is reached
+func (handler *Handler) serveAdmin(w http.ResponseWriter, r *http.Request) (int, error) {
+	if !handler.canAdmin(r) {
+		return http.StatusForbidden, nil
+	}
+
+	if r.Method != "GET" {
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	query := r.URL.Query()
+
+	if key := query.Get("key"); key != "" {
+		entry, found := handler.Cache.inspectKey(key)
+		if !found {
+			return http.StatusNotFound, nil
+		}
+		return writeAdminJSON(w, entry)
+	}
+
+	cursor, limit := 0, defaultAdminPageSize
+	if value := query.Get("cursor"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 || parsed >= cacheBucketsSize {
+			return http.StatusBadRequest, nil
+		}
+		cursor = parsed
+	}
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return http.StatusBadRequest, nil
+		}
+		limit = parsed
+	}
+
+	return writeAdminJSON(w, handler.Cache.inspect(query.Get("prefix"), cursor, limit))
+}
+
+func writeAdminJSON(w http.ResponseWriter, value interface{}) (int, error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	return http.StatusOK, json.NewEncoder(w).Encode(value)
+}
+
+// inspect lists the entries with the given key prefix walking
+// the buckets from cursor until the limit is reached
+func (cache *HTTPCache) inspect(prefix string, cursor int, limit int) adminPage {
+	page := adminPage{Entries: []adminEntry{}}
+
+	for bucket := cursor; bucket < cacheBucketsSize; bucket++ {
+		cache.entriesLock[bucket].RLock()
+		for key, entries := range cache.entries[bucket] {
+			if strings.HasPrefix(key, prefix) {
+				page.Entries = append(page.Entries, describeEntries(key, entries, false))
+			}
+		}
+		cache.entriesLock[bucket].RUnlock()
+
+		// Whole buckets are returned so the cursor does not skip entries
+		if len(page.Entries) >= limit && bucket+1 < cacheBucketsSize {
+			next := bucket + 1
+			page.NextCursor = &next
+			break
+		}
+	}
+
+	sort.Slice(page.Entries, func(i, j int) bool {
+		return page.Entries[i].Key < page.Entries[j].Key
+	})
+	return page
+}
+
+// inspectKey returns the variants stored for the key with their headers
+func (cache *HTTPCache) inspectKey(key string) (adminEntry, bool) {
+	bucket := cache.getBucketIndexForKey(key)
+	cache.entriesLock[bucket].RLock()
+	defer cache.entriesLock[bucket].RUnlock()
+
+	entries, exists := cache.entries[bucket][key]
+	if !exists {
+		return adminEntry{}, false
+	}
+	return describeEntries(key, entries, true), true
+}
+
+func describeEntries(key string, entries []*HTTPCacheEntry, withHeaders bool) adminEntry {
+	described := adminEntry{Key: key, Variants: []adminVariant{}}
+
+	for _, entry := range entries {
+		variant := adminVariant{
+			Vary:        entry.varyHeaders(),
+			Status:      entry.Response.Code,
+			Size:        entry.Response.storedSize(),
+			Public:      entry.isPublic,
+			Expiration:  entry.expiration,
+			StoredUntil: entry.storedUntil,
+			Age:         int64(now().Sub(entry.storedAt) / time.Second),
+			Hits:        entry.Response.servedCount(),
+			Tags:        entry.tags,
+		}
+		if withHeaders {
+			variant.Headers = entry.Response.snapHeader
+		}
+		described.Variants = append(described.Variants, variant)
+	}
+
+	return described
+}
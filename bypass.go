@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// BypassRule sends the requests that match all its conditions
+// upstream without using the cache
+type BypassRule struct {
+	Name       string
+	Conditions []BypassCondition
+}
+
+// BypassCondition determines if a request matches a bypass rule
+type BypassCondition interface {
+	matches(*http.Request) bool
+}
+
+// CookieBypassCondition matches if the request has the cookie
+// and, if Value is not empty, it has that value
+type CookieBypassCondition struct {
+	Name  string
+	Value string
+}
+
+// HeaderBypassCondition matches if the request has the header
+// and, if Value is not empty, it has that value
+type HeaderBypassCondition struct {
+	Header string
+	Value  string
+}
+
+// QueryBypassCondition matches if the request has the query parameter
+// and, if Value is not empty, it has that value
+type QueryBypassCondition struct {
+	Param string
+	Value string
+}
+
+// PathBypassCondition matches if the request path matches any of the globs
+// A * in a glob matches any characters, including /
+type PathBypassCondition struct {
+	Globs []string
+}
+
+// IPBypassCondition matches if the client address is in any of the networks
+type IPBypassCondition struct {
+	Networks []*net.IPNet
+}
+
+// MethodBypassCondition matches if the request has any of the methods
+type MethodBypassCondition struct {
+	Methods []string
+}
+
+func (rule *BypassRule) matches(r *http.Request) bool {
+	for _, condition := range rule.Conditions {
+		if !condition.matches(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func (condition *CookieBypassCondition) matches(r *http.Request) bool {
+	cookie, err := r.Cookie(condition.Name)
+	if err != nil {
+		return false
+	}
+	return condition.Value == "" || cookie.Value == condition.Value
+}
+
+func (condition *HeaderBypassCondition) matches(r *http.Request) bool {
+	values, exists := r.Header[http.CanonicalHeaderKey(condition.Header)]
+	if !exists {
+		return false
+	}
+	return condition.Value == "" || containsString(values, condition.Value)
+}
+
+func (condition *QueryBypassCondition) matches(r *http.Request) bool {
+	values, exists := r.URL.Query()[condition.Param]
+	if !exists {
+		return false
+	}
+	return condition.Value == "" || containsString(values, condition.Value)
+}
+
+func (condition *PathBypassCondition) matches(r *http.Request) bool {
+	for _, glob := range condition.Globs {
+		if matchGlob(glob, r.URL.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (condition *IPBypassCondition) matches(r *http.Request) bool {
+	return ipInNetworks(clientIP(r), condition.Networks)
+}
+
+func (condition *MethodBypassCondition) matches(r *http.Request) bool {
+	return containsString(condition.Methods, r.Method)
+}
+
+// matchingBypassRule returns the first bypass rule that matches the request
+func (handler *Handler) matchingBypassRule(r *http.Request) *BypassRule {
+	for i := range handler.Config.BypassRules {
+		if handler.Config.BypassRules[i].matches(r) {
+			return &handler.Config.BypassRules[i]
+		}
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob returns if the value matches the glob where * matches any characters
+func matchGlob(glob string, value string) bool {
+	parts := strings.Split(glob, "*")
+	if len(parts) == 1 {
+		return glob == value
+	}
+
+	if !strings.HasPrefix(value, parts[0]) {
+		return false
+	}
+	value = value[len(parts[0]):]
+
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		index := strings.Index(value, part)
+		if index < 0 {
+			return false
+		}
+		value = value[index+len(part):]
+	}
+
+	return len(value) >= len(last) && strings.HasSuffix(value, last)
+}
@@ -0,0 +1,65 @@
+package cache
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBypassConditions(t *testing.T) {
+	r := makeRequest("/drafts/2019/post?preview=1&page=2", http.Header{
+		"Authorization": []string{"Bearer abc"},
+		"Cookie":        []string{"session_id=123; theme=dark"},
+	})
+	r.RemoteAddr = "10.0.0.1:1234"
+
+	tests := []struct {
+		name      string
+		condition BypassCondition
+		matches   bool
+	}{
+		{"cookie exists", &CookieBypassCondition{Name: "session_id"}, true},
+		{"cookie value", &CookieBypassCondition{Name: "theme", Value: "light"}, false},
+		{"missing cookie", &CookieBypassCondition{Name: "user"}, false},
+		{"header exists", &HeaderBypassCondition{Header: "authorization"}, true},
+		{"header value", &HeaderBypassCondition{Header: "Authorization", Value: "Bearer abc"}, true},
+		{"missing header", &HeaderBypassCondition{Header: "X-Preview"}, false},
+		{"query value", &QueryBypassCondition{Param: "preview", Value: "1"}, true},
+		{"missing query", &QueryBypassCondition{Param: "nocache"}, false},
+		{"path glob", &PathBypassCondition{Globs: []string{"/admin/*", "/drafts/*"}}, true},
+		{"path glob with inner wildcard", &PathBypassCondition{Globs: []string{"/*/2019/*"}}, true},
+		{"path not matched", &PathBypassCondition{Globs: []string{"/drafts"}}, false},
+		{"ip", &IPBypassCondition{Networks: []*net.IPNet{mustParseNetwork("10.0.0.0/8")}}, true},
+		{"other ip", &IPBypassCondition{Networks: []*net.IPNet{mustParseNetwork("192.168.0.0/16")}}, false},
+		{"method", &MethodBypassCondition{Methods: []string{"HEAD", "GET"}}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			require.Equal(t, test.matches, test.condition.matches(r))
+		})
+	}
+
+	t.Run("a rule requires all its conditions", func(t *testing.T) {
+		rule := &BypassRule{Name: "a", Conditions: []BypassCondition{
+			&CookieBypassCondition{Name: "session_id"},
+			&MethodBypassCondition{Methods: []string{"GET"}},
+		}}
+		require.True(t, rule.matches(r))
+
+		rule.Conditions = append(rule.Conditions, &QueryBypassCondition{Param: "nocache"})
+		require.False(t, rule.matches(r))
+	})
+}
+
+func TestMatchGlob(t *testing.T) {
+	require.True(t, matchGlob("/a", "/a"))
+	require.False(t, matchGlob("/a", "/ab"))
+	require.True(t, matchGlob("/a/*", "/a/b/c"))
+	require.True(t, matchGlob("*.css", "/a/b.css"))
+	require.True(t, matchGlob("/a*b", "/ab"))
+	require.False(t, matchGlob("/a*b*b", "/ab"))
+	require.True(t, matchGlob("/a*b*c", "/aXbYbZc"))
+}
@@ -5,18 +5,39 @@ import (
 	"math"
 	"net/http"
 	"sync"
-	"time"
+	"sync/atomic"
 )
 
 const cacheBucketsSize = 256
 
 type HTTPCache struct {
 	cacheKeyTemplate string
+	keyNormalization *KeyNormalization
 	entries          [cacheBucketsSize]map[string][]*HTTPCacheEntry
 	entriesLock      [cacheBucketsSize]*sync.RWMutex
+
+	// Entries are removed when they are not stored anymore
+	expirations *expirationScheduler
+
+	// Least recently used entries are evicted when the limits are exceeded
+	lru           *lruList
+	maxEntries    int
+	maxDiskSize   int64
+	maxMemorySize int64
+
+	// Entries are persisted next to their bodies to survive restarts
+	persistent bool
+	// A closed cache does not remove stored bodies anymore
+	closed int32
+	// Held while files are removed, so Close waits for the running removals
+	closeLock *sync.RWMutex
+	// Number of entries evicted, used atomically
+	evictions uint64
 }
 
-func NewHTTPCache(cacheKeyTemplate string) *HTTPCache {
+// NewHTTPCache creates an empty cache. A maxEntries, maxDiskSize or maxMemorySize of 0 means there
+// is no limit and a nil keyNormalization builds the keys without normalizing the URLs
+func NewHTTPCache(cacheKeyTemplate string, keyNormalization *KeyNormalization, maxEntries int, maxDiskSize int64, maxMemorySize int64) *HTTPCache {
 	entriesLocks := [cacheBucketsSize]*sync.RWMutex{}
 	entries := [cacheBucketsSize]map[string][]*HTTPCacheEntry{}
 
@@ -25,15 +46,23 @@ func NewHTTPCache(cacheKeyTemplate string) *HTTPCache {
 		entries[i] = make(map[string][]*HTTPCacheEntry)
 	}
 
-	return &HTTPCache{
+	cache := &HTTPCache{
 		cacheKeyTemplate: cacheKeyTemplate,
+		keyNormalization: keyNormalization,
 		entries:          entries,
 		entriesLock:      entriesLocks,
+		lru:              newLRUList(),
+		maxEntries:       maxEntries,
+		maxDiskSize:      maxDiskSize,
+		maxMemorySize:    maxMemorySize,
+		closeLock:        new(sync.RWMutex),
 	}
+	cache.expirations = newExpirationScheduler(cache.cleanEntry)
+	return cache
 }
 
 func (cache *HTTPCache) Get(request *http.Request) (*HTTPCacheEntry, bool) {
-	key := getKey(cache.cacheKeyTemplate, request)
+	key := getKey(cache.cacheKeyTemplate, cache.keyNormalization, request)
 	b := cache.getBucketIndexForKey(key)
 	cache.entriesLock[b].RLock()
 	defer cache.entriesLock[b].RUnlock()
@@ -45,7 +74,8 @@ func (cache *HTTPCache) Get(request *http.Request) (*HTTPCacheEntry, bool) {
 	}
 
 	for _, entry := range previousEntries {
-		if entry.Fresh() && matchesVary(request, entry) {
+		if entry.Stored() && matchesVary(request, entry) {
+			cache.lru.touch(entry)
 			return entry, true
 		}
 	}
@@ -53,31 +83,212 @@ func (cache *HTTPCache) Get(request *http.Request) (*HTTPCacheEntry, bool) {
 	return nil, false
 }
 
-func (cache *HTTPCache) Put(request *http.Request, entry *HTTPCacheEntry) {
+// Put stores the entry. It returns false if the entry reuses the body of a revalidated
+// entry that was removed meanwhile, because that body is already cleaned
+func (cache *HTTPCache) Put(request *http.Request, entry *HTTPCacheEntry) bool {
+	// Restored entries keep the time they were stored by the previous process
+	entry.storedAt = now()
+	if !cache.put(entry) {
+		return false
+	}
+	go cache.trackStored(entry)
+	cache.evict()
+	return true
+}
+
+func (cache *HTTPCache) put(entry *HTTPCacheEntry) bool {
 	key := entry.Key()
 	bucket := cache.getBucketIndexForKey(key)
 
 	cache.entriesLock[bucket].Lock()
 	defer cache.entriesLock[bucket].Unlock()
 
+	if entry.Response.revalidatedFrom != nil && !cache.isLiveResponse(bucket, key, entry.Response.revalidatedFrom) {
+		return false
+	}
+
 	cache.scheduleCleanEntry(entry)
 
+	// Private entries only remember that the response is not stored,
+	// so they do not count towards the limits and are never evicted
+	if entry.isPublic {
+		cache.lru.add(entry)
+	}
+
 	for i, previousEntry := range cache.entries[bucket][key] {
 		if matchesVary(entry.Request, previousEntry) {
-			go previousEntry.Clean()
+			cache.lru.remove(previousEntry)
+			cache.expirations.remove(previousEntry)
+			if !entry.sharesBodyWith(previousEntry) {
+				cache.clean(previousEntry)
+			}
 			cache.entries[bucket][key][i] = entry
-			return
+			return true
 		}
 	}
 
 	cache.entries[bucket][key] = append(cache.entries[bucket][key], entry)
+	return true
 }
 
-func (cache *HTTPCache) scheduleCleanEntry(entry *HTTPCacheEntry) {
-	go func(entry *HTTPCacheEntry) {
-		time.Sleep(entry.expiration.Sub(time.Now().UTC()))
+// isLiveResponse returns if the response belongs to an entry that is still stored
+// The bucket lock must be held by the caller
+func (cache *HTTPCache) isLiveResponse(bucket uint32, key string, response *Response) bool {
+	for _, entry := range cache.entries[bucket][key] {
+		if entry.Response == response {
+			return true
+		}
+	}
+	return false
+}
+
+// trackStored waits until the whole body is stored to account its size
+// and persist the entry. Bodies kept in memory count towards the memory size
+func (cache *HTTPCache) trackStored(entry *HTTPCacheEntry) {
+	if !entry.isPublic {
+		return
+	}
+
+	entry.Response.WaitClose()
+	switch {
+	case entry.Response.storedInMemory():
+		cache.lru.setSize(entry, entry.Response.storedSize(), true)
+	case entry.Response.storedOnDisk():
+		cache.lru.setSize(entry, entry.Response.storedSize(), false)
+		cache.persistIfStored(entry)
+	default:
+		return
+	}
+	cache.evict()
+}
+
+// persistIfStored persists the entry unless it was already removed,
+// otherwise its metadata could be left after the body is cleaned
+func (cache *HTTPCache) persistIfStored(entry *HTTPCacheEntry) {
+	if !cache.persistent {
+		return
+	}
+
+	bucket := cache.getBucketIndexForKey(entry.Key())
+	cache.entriesLock[bucket].Lock()
+	defer cache.entriesLock[bucket].Unlock()
+
+	for _, otherEntry := range cache.entries[bucket][entry.Key()] {
+		if otherEntry == entry {
+			entry.persist()
+			return
+		}
+	}
+}
+
+// evict removes the least recently used entries until the cache is within its limits
+func (cache *HTTPCache) evict() {
+	if cache.maxEntries <= 0 && cache.maxDiskSize <= 0 && cache.maxMemorySize <= 0 {
+		return
+	}
+
+	victims := cache.lru.overLimit(cache.maxEntries, cache.maxDiskSize, cache.maxMemorySize)
+	for _, entry := range victims {
 		cache.cleanEntry(entry)
-	}(entry)
+	}
+	atomic.AddUint64(&cache.evictions, uint64(len(victims)))
+}
+
+// PurgeMode selects what is done with purged entries
+type PurgeMode int
+
+const (
+	// HardPurge removes the entries and their stored bodies
+	HardPurge PurgeMode = iota
+	// SoftPurge marks the entries as stale so they are revalidated
+	SoftPurge
+	// DryRunPurge only reports which entries would be purged
+	DryRunPurge
+)
+
+// Purge purges every entry stored with the given key, including
+// all its Vary variants, and returns the key once per purged entry
+func (cache *HTTPCache) Purge(key string, mode PurgeMode) []string {
+	bucket := cache.getBucketIndexForKey(key)
+
+	cache.entriesLock[bucket].Lock()
+	defer cache.entriesLock[bucket].Unlock()
+
+	return cache.purgeKey(bucket, key, func(*HTTPCacheEntry) bool { return true }, mode)
+}
+
+// PurgeTags purges every entry that has any of the given tags
+func (cache *HTTPCache) PurgeTags(tags []string, mode PurgeMode) []string {
+	return cache.PurgeWhere(func(entry *HTTPCacheEntry) bool {
+		return entry.hasAnyTag(tags)
+	}, mode)
+}
+
+// PurgeWhere walks every bucket and purges the entries that match.
+// It returns the key of each purged entry
+func (cache *HTTPCache) PurgeWhere(matches func(*HTTPCacheEntry) bool, mode PurgeMode) []string {
+	purged := []string{}
+
+	for bucket := uint32(0); bucket < cacheBucketsSize; bucket++ {
+		cache.entriesLock[bucket].Lock()
+		for key := range cache.entries[bucket] {
+			purged = append(purged, cache.purgeKey(bucket, key, matches, mode)...)
+		}
+		cache.entriesLock[bucket].Unlock()
+	}
+
+	return purged
+}
+
+// purgeKey purges the matching entries of a single key
+// The bucket lock must be held by the caller
+func (cache *HTTPCache) purgeKey(bucket uint32, key string, matches func(*HTTPCacheEntry) bool, mode PurgeMode) []string {
+	purged := []string{}
+	kept := []*HTTPCacheEntry{}
+
+	for _, entry := range cache.entries[bucket][key] {
+		if !matches(entry) {
+			kept = append(kept, entry)
+			continue
+		}
+
+		purged = append(purged, key)
+
+		switch mode {
+		case DryRunPurge:
+			kept = append(kept, entry)
+		case SoftPurge:
+			stale := entry.markedStale()
+			cache.expirations.remove(entry)
+			cache.scheduleCleanEntry(stale)
+			cache.lru.replace(entry, stale)
+			if cache.persistent && stale.Response.storedOnDisk() {
+				stale.persist()
+			}
+			kept = append(kept, stale)
+		default:
+			cache.lru.remove(entry)
+			cache.expirations.remove(entry)
+			cache.clean(entry)
+		}
+	}
+
+	if len(kept) == 0 {
+		delete(cache.entries[bucket], key)
+	} else {
+		cache.entries[bucket][key] = kept
+	}
+
+	return purged
+}
+
+func (cache *HTTPCache) scheduleCleanEntry(entry *HTTPCacheEntry) {
+	cache.expirations.schedule(entry, entry.storedUntil)
+}
+
+// PendingExpirations returns how many entries are scheduled to be removed
+func (cache *HTTPCache) PendingExpirations() int {
+	return cache.expirations.pending()
 }
 
 func (cache *HTTPCache) cleanEntry(entry *HTTPCacheEntry) {
@@ -90,12 +301,49 @@ func (cache *HTTPCache) cleanEntry(entry *HTTPCacheEntry) {
 	for i, otherEntry := range cache.entries[bucket][key] {
 		if entry == otherEntry {
 			cache.entries[bucket][key] = append(cache.entries[bucket][key][:i], cache.entries[bucket][key][i+1:]...)
-			entry.Clean()
+			cache.lru.remove(entry)
+			cache.expirations.remove(entry)
+			cache.clean(entry)
 			return
 		}
 	}
 }
 
+// clean removes the stored body of an entry that is not in the cache anymore
+func (cache *HTTPCache) clean(entry *HTTPCacheEntry) {
+	if cache.isClosed() {
+		return
+	}
+	go cache.whileOpen(func() { entry.Clean() })
+}
+
+// whileOpen runs remove unless the cache is closed and returns if it was run
+func (cache *HTTPCache) whileOpen(remove func()) bool {
+	cache.closeLock.RLock()
+	defer cache.closeLock.RUnlock()
+
+	if cache.isClosed() {
+		return false
+	}
+	remove()
+	return true
+}
+
+// Close stops removing stored bodies, so after a reload the new cache can keep
+// using the persisted entries. It returns once the running removals finish
+func (cache *HTTPCache) Close() {
+	cache.closeLock.Lock()
+	atomic.StoreInt32(&cache.closed, 1)
+	cache.closeLock.Unlock()
+
+	cache.expirations.stop()
+	releasePath(cache)
+}
+
+func (cache *HTTPCache) isClosed() bool {
+	return atomic.LoadInt32(&cache.closed) == 1
+}
+
 func (cache *HTTPCache) getBucketIndexForKey(key string) uint32 {
 	return uint32(math.Mod(float64(crc32.ChecksumIEEE([]byte(key))), float64(cacheBucketsSize)))
 }
@@ -3,6 +3,8 @@ package cache
 import (
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/nicolasazrak/caddy-cache/storage"
@@ -10,9 +12,14 @@ import (
 
 // HTTPCacheEntry saves the request response of an http request
 type HTTPCacheEntry struct {
-	isPublic   bool
-	expiration time.Time
-	key        string
+	isPublic          bool
+	expiration        time.Time
+	staleUntil        time.Time
+	staleIfErrorUntil time.Time
+	storedUntil       time.Time
+	storedAt          time.Time
+	key               string
+	tags              []string
 
 	Request  *http.Request
 	Response *Response
@@ -23,12 +30,37 @@ type HTTPCacheEntry struct {
 func NewHTTPCacheEntry(key string, request *http.Request, response *Response, config *Config) *HTTPCacheEntry {
 	isPublic, expiration := getCacheableStatus(request, response, config)
 
+	// Stale entries are kept a while if they can be revalidated upstream,
+	// served while they are refreshed in background or served if upstream fails
+	staleUntil := expiration
+	staleIfErrorUntil := expiration
+	storedUntil := expiration
+	if isPublic {
+		whileRevalidate, ifError := getStaleWindows(response.snapHeader, config)
+		staleUntil = expiration.Add(whileRevalidate)
+		staleIfErrorUntil = expiration.Add(ifError)
+
+		storedUntil = latest(staleUntil, staleIfErrorUntil)
+		if hasValidators(response.snapHeader) {
+			storedUntil = latest(storedUntil, expiration.Add(config.KeepStale))
+		}
+	}
+
+	tags := parseTags(response.snapHeader.Get(config.TagHeader))
+	if isPublic && rewritesHeaders(config) {
+		rewriteHeaders(response.snapHeader, request, key, config)
+	}
+
 	return &HTTPCacheEntry{
-		key:        key,
-		isPublic:   isPublic,
-		expiration: expiration,
-		Request:    request,
-		Response:   response,
+		key:               key,
+		isPublic:          isPublic,
+		expiration:        expiration,
+		staleUntil:        staleUntil,
+		staleIfErrorUntil: staleIfErrorUntil,
+		storedUntil:       storedUntil,
+		tags:              tags,
+		Request:           request,
+		Response:          response,
 	}
 }
 
@@ -66,6 +98,11 @@ func (e *HTTPCacheEntry) WriteBodyTo(w http.ResponseWriter) error {
 }
 
 func (e *HTTPCacheEntry) setStorage(config *Config) error {
+	if e.storeInMemory(config) {
+		e.Response.SetBody(storage.NewMemoryStorage())
+		return nil
+	}
+
 	storage, err := storage.NewFileStorage(config.Path)
 
 	// Set the storage even if it is nil to continue and stop the upstream request
@@ -74,7 +111,117 @@ func (e *HTTPCacheEntry) setStorage(config *Config) error {
 	return err
 }
 
+// storeInMemory returns if the body should be kept in memory.
+// With a max size only bodies with a known Content-Length below it are kept in memory
+func (e *HTTPCacheEntry) storeInMemory(config *Config) bool {
+	if config.Storage != memoryStorage {
+		return false
+	}
+
+	if config.MemoryStorageMaxSize <= 0 {
+		return true
+	}
+
+	length, err := strconv.ParseInt(e.Response.snapHeader.Get("Content-Length"), 10, 64)
+	return err == nil && length <= config.MemoryStorageMaxSize
+}
+
 // Fresh returns if the entry is still fresh
 func (e *HTTPCacheEntry) Fresh() bool {
-	return e.expiration.After(time.Now())
+	return e.expiration.After(now())
+}
+
+// age returns how long ago the response was generated upstream,
+// including the Age it already had when it was received
+func (e *HTTPCacheEntry) age() time.Duration {
+	age := now().Sub(e.storedAt)
+	if received, err := strconv.ParseInt(e.Response.snapHeader.Get("Age"), 10, 64); err == nil && received > 0 {
+		age += time.Duration(received) * time.Second
+	}
+
+	if age < 0 {
+		return 0
+	}
+	return age
+}
+
+// Stored returns if the entry can still be used, either because
+// it is fresh or because it is stale but can be revalidated
+func (e *HTTPCacheEntry) Stored() bool {
+	return e.storedUntil.After(now())
+}
+
+// markedStale returns a copy of the entry that is already expired so the next
+// request revalidates it. The copy shares the stored body with the entry
+func (e *HTTPCacheEntry) markedStale() *HTTPCacheEntry {
+	stale := *e
+	if current := now(); stale.expiration.After(current) {
+		// The stale windows start when the entry expires
+		elapsed := current.Sub(stale.expiration)
+		stale.expiration = current
+		stale.staleUntil = stale.staleUntil.Add(elapsed)
+		stale.staleIfErrorUntil = stale.staleIfErrorUntil.Add(elapsed)
+	}
+	return &stale
+}
+
+// varyHeaders returns the request headers used to match the Vary header
+func (e *HTTPCacheEntry) varyHeaders() http.Header {
+	headers := http.Header{}
+	for _, header := range strings.Split(e.Response.HeaderMap.Get("Vary"), ",") {
+		header = http.CanonicalHeaderKey(strings.TrimSpace(header))
+		if values, exists := e.Request.Header[header]; exists {
+			headers[header] = values
+		}
+	}
+	return headers
+}
+
+// hasAnyTag returns if the entry was tagged with any of the given tags
+func (e *HTTPCacheEntry) hasAnyTag(tags []string) bool {
+	for _, tag := range tags {
+		for _, entryTag := range e.tags {
+			if tag == entryTag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasActiveReaders returns if the stored body is being read
+func (e *HTTPCacheEntry) hasActiveReaders() bool {
+	// Private entries have no stored body
+	return e.isPublic && e.Response.hasReaders()
+}
+
+// canServeStale returns if the entry can be served while
+// it is refreshed in background
+func (e *HTTPCacheEntry) canServeStale() bool {
+	return e.isPublic && e.staleUntil.After(now())
+}
+
+// canServeStaleIfError returns if the entry can be served
+// because upstream failed to send a new response
+func (e *HTTPCacheEntry) canServeStaleIfError() bool {
+	return e.isPublic && e.staleIfErrorUntil.After(now())
+}
+
+// canRevalidate returns if the entry has an ETag or Last-Modified header
+// that can be used to make a conditional request upstream
+func (e *HTTPCacheEntry) canRevalidate() bool {
+	return e.isPublic && hasValidators(e.Response.snapHeader)
+}
+
+// sharesBodyWith returns if the entry body is the same as other's because
+// it was created revalidating other
+func (e *HTTPCacheEntry) sharesBodyWith(other *HTTPCacheEntry) bool {
+	return e.Response.revalidatedFrom == other.Response
+}
+
+func latest(a time.Time, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
 }
@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const cacheStatusHeader = "Cache-Status"
+
+// addCacheHeaders sets the Age of responses served from the cache and
+// appends the Via and Cache-Status headers when they are configured
+func (handler *Handler) addCacheHeaders(w http.ResponseWriter, entry *HTTPCacheEntry, status string) {
+	if entry.isPublic && servedFrom(status) == servedFromCache {
+		w.Header().Set("Age", strconv.FormatInt(int64(entry.age()/time.Second), 10))
+	}
+
+	handler.addVia(w)
+
+	if handler.Config.CacheStatusName != "" {
+		w.Header().Add(cacheStatusHeader, handler.cacheStatus(entry, status))
+	}
+}
+
+// addVia appends the configured pseudonym to the Via header
+func (handler *Handler) addVia(w http.ResponseWriter) {
+	if handler.Config.Via != "" {
+		w.Header().Add("Via", "1.1 "+handler.Config.Via)
+	}
+}
+
+// cacheStatus returns the Cache-Status value described in RFC 9211
+// The entry is nil when the request bypassed the cache
+func (handler *Handler) cacheStatus(entry *HTTPCacheEntry, status string) string {
+	params := []string{sfToken(handler.Config.CacheStatusName)}
+
+	switch status {
+	case cacheHit:
+		params = append(params, "hit")
+	case cacheStale:
+		params = append(params, "hit", "detail=stale")
+	case cacheStaleError:
+		params = append(params, "hit", "detail=stale-if-error")
+	case cacheRevalidated:
+		params = append(params, "fwd=stale", "fwd-status=304")
+	case cacheMiss:
+		params = append(params, "fwd=uri-miss")
+	case cacheSkip:
+		params = append(params, "fwd=miss", "detail=private")
+	case cacheBypass:
+		params = append(params, "fwd=bypass")
+	}
+
+	if entry == nil {
+		return strings.Join(params, "; ")
+	}
+
+	if status == cacheMiss && entry.isPublic {
+		params = append(params, "stored")
+	}
+
+	if entry.isPublic {
+		ttl := int64(entry.expiration.Sub(now()) / time.Second)
+		params = append(params, "ttl="+strconv.FormatInt(ttl, 10))
+	}
+
+	if handler.Config.CacheStatusKey {
+		params = append(params, "key="+sfString(entry.Key()))
+	}
+
+	return strings.Join(params, "; ")
+}
+
+// sfToken returns the name as a structured field token or as a string if it is not a valid token
+func sfToken(name string) string {
+	for i, c := range name {
+		isAlpha := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		if (i == 0 && !isAlpha && c != '*') || (c <= ' ' || c >= 0x7f || strings.ContainsRune(`"(),;<=>?@[\]{}`, c)) {
+			return sfString(name)
+		}
+	}
+	return name
+}
+
+// sfString quotes a structured field string
+func sfString(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
@@ -0,0 +1,134 @@
+package cache
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// clientNotModified checks the conditional headers sent by the client against
+// the stored response and returns true if a 304 Not Modified can be sent instead
+// of the stored body. As described in RFC 7232 section 6, If-Modified-Since is
+// only evaluated when the request has no If-None-Match.
+func clientNotModified(req *http.Request, code int, headers http.Header) bool {
+	if code != http.StatusOK || (req.Method != "GET" && req.Method != "HEAD") {
+		return false
+	}
+
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		return etagMatchesAny(ifNoneMatch, headers.Get("ETag"))
+	}
+
+	ifModifiedSince := req.Header.Get("If-Modified-Since")
+	lastModified := headers.Get("Last-Modified")
+	if ifModifiedSince == "" || lastModified == "" {
+		return false
+	}
+
+	since, err := http.ParseTime(ifModifiedSince)
+	if err != nil {
+		return false
+	}
+
+	modified, err := http.ParseTime(lastModified)
+	if err != nil {
+		return false
+	}
+
+	// Dates in headers have a resolution of one second
+	return !modified.Truncate(time.Second).After(since)
+}
+
+// etagMatchesAny uses the weak comparison function to check if etag
+// is in the list of entity tags of an If-None-Match header
+func etagMatchesAny(list string, etag string) bool {
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+
+	if etag == "" {
+		return false
+	}
+
+	for _, candidate := range splitETags(list) {
+		if weakETagMatch(candidate, etag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// weakETagMatch compares two entity tags ignoring the weak indicator
+func weakETagMatch(a string, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// splitETags splits a list of entity tags taking care of commas
+// inside the quoted part of each one
+func splitETags(list string) []string {
+	etags := []string{}
+	inQuotes := false
+	start := 0
+
+	for i := 0; i < len(list); i++ {
+		switch list[i] {
+		case '"':
+			inQuotes = !inQuotes
+		case ',':
+			if !inQuotes {
+				etags = appendETag(etags, list[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return appendETag(etags, list[start:])
+}
+
+func appendETag(etags []string, etag string) []string {
+	etag = strings.TrimSpace(etag)
+	if etag == "" {
+		return etags
+	}
+	return append(etags, etag)
+}
+
+// writeNotModified sends a 304 without the headers that describe the body
+func writeNotModified(w http.ResponseWriter) {
+	h := w.Header()
+	h.Del("Content-Type")
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	if h.Get("ETag") != "" {
+		h.Del("Last-Modified")
+	}
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// ifRangeMatches returns if the Range header can be used. If the request has an If-Range
+// header it has to be equal to the stored ETag using the strong comparison function,
+// or to the stored Last-Modified date
+func ifRangeMatches(req *http.Request, headers http.Header) bool {
+	ifRange := req.Header.Get("If-Range")
+	if ifRange == "" {
+		return true
+	}
+
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		etag := headers.Get("ETag")
+		return etag != "" && !strings.HasPrefix(etag, "W/") && ifRange == etag
+	}
+
+	since, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+
+	lastModified, err := http.ParseTime(headers.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+
+	return lastModified.Equal(since)
+}
@@ -0,0 +1,43 @@
+package cache
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientNotModified(t *testing.T) {
+	stored := http.Header{}
+	stored.Set("ETag", `W/"abc"`)
+	stored.Set("Last-Modified", "Wed, 21 Oct 2015 07:28:00 GMT")
+
+	tests := []struct {
+		name     string
+		headers  http.Header
+		code     int
+		expected bool
+	}{
+		{"no validators", http.Header{}, 200, false},
+		{"same etag", makeHeader("If-None-Match", `W/"abc"`), 200, true},
+		{"strong etag matches weak one", makeHeader("If-None-Match", `"abc"`), 200, true},
+		{"etag in a list", makeHeader("If-None-Match", `"x,y", "abc"`), 200, true},
+		{"different etag", makeHeader("If-None-Match", `"abcd"`), 200, false},
+		{"wildcard", makeHeader("If-None-Match", "*"), 200, true},
+		{"wildcard with other status", makeHeader("If-None-Match", "*"), 404, false},
+		{"not modified since", makeHeader("If-Modified-Since", "Wed, 21 Oct 2015 07:28:00 GMT"), 200, true},
+		{"modified since", makeHeader("If-Modified-Since", "Tue, 20 Oct 2015 07:28:00 GMT"), 200, false},
+		{"invalid date", makeHeader("If-Modified-Since", "yesterday"), 200, false},
+		{"etag has precedence over date", http.Header{
+			"If-None-Match":     []string{`"other"`},
+			"If-Modified-Since": []string{"Wed, 21 Oct 2015 07:28:00 GMT"},
+		}, 200, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := makeRequest("/", test.headers)
+			require.Equal(t, test.expected, clientNotModified(req, test.code, stored))
+		})
+	}
+}
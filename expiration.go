@@ -0,0 +1,145 @@
+package cache
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// expirationScheduler removes the entries from the cache when they are
+// not stored anymore. A single timer is used for the next expiration
+type expirationScheduler struct {
+	lock    *sync.Mutex
+	queue   expirationQueue
+	items   map[*HTTPCacheEntry]*expirationItem
+	timer   *time.Timer
+	stopped bool
+	expire  func(*HTTPCacheEntry)
+}
+
+type expirationItem struct {
+	entry *HTTPCacheEntry
+	at    time.Time
+	index int
+}
+
+func newExpirationScheduler(expire func(*HTTPCacheEntry)) *expirationScheduler {
+	return &expirationScheduler{
+		lock:   new(sync.Mutex),
+		items:  make(map[*HTTPCacheEntry]*expirationItem),
+		expire: expire,
+	}
+}
+
+// schedule expires the entry at the given time, replacing its previous expiration
+func (s *expirationScheduler) schedule(entry *HTTPCacheEntry, at time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if item, exists := s.items[entry]; exists {
+		item.at = at
+		heap.Fix(&s.queue, item.index)
+	} else {
+		item := &expirationItem{entry: entry, at: at}
+		heap.Push(&s.queue, item)
+		s.items[entry] = item
+	}
+
+	s.resetTimer()
+}
+
+// remove cancels the expiration of the entry
+func (s *expirationScheduler) remove(entry *HTTPCacheEntry) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	item, exists := s.items[entry]
+	if !exists {
+		return
+	}
+
+	heap.Remove(&s.queue, item.index)
+	delete(s.items, entry)
+	s.resetTimer()
+}
+
+// pending returns how many entries are waiting to expire
+func (s *expirationScheduler) pending() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.items)
+}
+
+// expireDue expires every entry whose time already passed
+func (s *expirationScheduler) expireDue() {
+	s.lock.Lock()
+	due := []*HTTPCacheEntry{}
+	current := now()
+	for len(s.queue) > 0 && !s.queue[0].at.After(current) {
+		item := heap.Pop(&s.queue).(*expirationItem)
+		delete(s.items, item.entry)
+		due = append(due, item.entry)
+	}
+	s.resetTimer()
+	s.lock.Unlock()
+
+	// expire takes the cache locks, it can not be called with the scheduler lock
+	for _, entry := range due {
+		s.expire(entry)
+	}
+}
+
+// stop cancels the timer, no more entries are expired
+func (s *expirationScheduler) stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.stopped = true
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+}
+
+// resetTimer sets the timer for the next expiration
+// The lock must be held by the caller
+func (s *expirationScheduler) resetTimer() {
+	if s.stopped || len(s.queue) == 0 {
+		return
+	}
+
+	wait := s.queue[0].at.Sub(now())
+	if s.timer == nil {
+		s.timer = time.AfterFunc(wait, s.expireDue)
+	} else {
+		s.timer.Reset(wait)
+	}
+}
+
+/////////////////////////////////////////
+
+// expirationQueue is a min heap of the expiration times
+type expirationQueue []*expirationItem
+
+func (q expirationQueue) Len() int { return len(q) }
+
+func (q expirationQueue) Less(i, j int) bool { return q[i].at.Before(q[j].at) }
+
+func (q expirationQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *expirationQueue) Push(x interface{}) {
+	item := x.(*expirationItem)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+
+func (q *expirationQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return item
+}
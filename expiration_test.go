@@ -0,0 +1,131 @@
+package cache
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock replaces now until restore is called
+type fakeClock struct {
+	lock    *sync.Mutex
+	current time.Time
+}
+
+var (
+	// now is replaced only once because timers left by other tests can still
+	// be calling it, the fake clock in use is swapped instead
+	currentClock     *fakeClock
+	currentClockLock = new(sync.Mutex)
+	realNow          = now
+)
+
+func init() {
+	now = func() time.Time {
+		currentClockLock.Lock()
+		clock := currentClock
+		currentClockLock.Unlock()
+
+		if clock == nil {
+			return realNow()
+		}
+		return clock.Now()
+	}
+}
+
+func useFakeClock() *fakeClock {
+	clock := &fakeClock{lock: new(sync.Mutex), current: time.Now()}
+	currentClockLock.Lock()
+	defer currentClockLock.Unlock()
+	currentClock = clock
+	return clock
+}
+
+func (c *fakeClock) restore() {
+	currentClockLock.Lock()
+	defer currentClockLock.Unlock()
+	if currentClock == c {
+		currentClock = nil
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.current
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.current = c.current.Add(d)
+}
+
+func TestExpirationScheduler(t *testing.T) {
+	clock := useFakeClock()
+	defer clock.restore()
+
+	newEntry := func(path string, storedFor time.Duration) *HTTPCacheEntry {
+		response := NewResponse()
+		response.SetBody(nil)
+		return &HTTPCacheEntry{
+			key:         path,
+			isPublic:    true,
+			storedUntil: clock.Now().Add(storedFor),
+			Request:     makeRequest("http://example.com"+path, http.Header{}),
+			Response:    response,
+		}
+	}
+
+	exists := func(cache *HTTPCache, path string) bool {
+		bucket := cache.getBucketIndexForKey(path)
+		cache.entriesLock[bucket].RLock()
+		defer cache.entriesLock[bucket].RUnlock()
+		return len(cache.entries[bucket][path]) > 0
+	}
+
+	t.Run("it should remove the entries once they are not stored", func(t *testing.T) {
+		cache := NewHTTPCache(defaultCacheKeyTemplate, nil, 0, 0, 0)
+		defer cache.Close()
+
+		cache.put(newEntry("/a", time.Minute))
+		cache.put(newEntry("/b", time.Hour))
+		require.Equal(t, 2, cache.PendingExpirations())
+
+		clock.Advance(time.Duration(2) * time.Minute)
+		cache.expirations.expireDue()
+
+		require.False(t, exists(cache, "/a"))
+		require.True(t, exists(cache, "/b"))
+		require.Equal(t, 1, cache.PendingExpirations())
+	})
+
+	t.Run("it should replace the expiration of replaced entries", func(t *testing.T) {
+		cache := NewHTTPCache(defaultCacheKeyTemplate, nil, 0, 0, 0)
+		defer cache.Close()
+
+		cache.put(newEntry("/a", time.Minute))
+		cache.put(newEntry("/a", time.Hour))
+		require.Equal(t, 1, cache.PendingExpirations())
+
+		clock.Advance(time.Duration(2) * time.Minute)
+		cache.expirations.expireDue()
+		require.True(t, exists(cache, "/a"))
+	})
+
+	t.Run("it should cancel the expiration of purged entries", func(t *testing.T) {
+		cache := NewHTTPCache(defaultCacheKeyTemplate, nil, 0, 0, 0)
+		defer cache.Close()
+
+		cache.put(newEntry("/a", time.Minute))
+		cache.put(newEntry("/b", time.Minute))
+		cache.Purge("/a", HardPurge)
+		require.Equal(t, 1, cache.PendingExpirations())
+
+		cache.Purge("/b", SoftPurge)
+		require.Equal(t, 1, cache.PendingExpirations())
+	})
+}
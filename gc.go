@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/nicolasazrak/caddy-cache/storage"
+)
+
+// gcGracePeriod is how long a file that is not in the cache is kept,
+// it could still be written by a request that did not store its entry yet
+var gcGracePeriod = time.Duration(10) * time.Minute
+
+// GCReport describes what a garbage collection removed
+type GCReport struct {
+	Files int
+	Bytes int64
+}
+
+// StartGC periodically removes the files in path that are not used by the cache
+// rateLimit is the maximum number of files removed per second, 0 means no limit
+// It stops when the cache is closed
+func (cache *HTTPCache) StartGC(path string, interval time.Duration, rateLimit int) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if cache.isClosed() {
+				return
+			}
+
+			report, err := cache.CollectGarbage(path, rateLimit)
+			if err != nil {
+				log.Printf("[ERROR] cache: garbage collection of %s failed: %v", path, err)
+				continue
+			}
+			if report.Files > 0 {
+				log.Printf("[INFO] cache: garbage collection removed %d files from %s, reclaimed %d bytes", report.Files, path, report.Bytes)
+			}
+		}
+	}()
+}
+
+// CollectGarbage removes the files in path that are not used by any entry
+// of the cache, like the ones left by a crash. Files that are expired
+// according to their metadata are removed right away, the rest
+// only after a grace period since they were last written
+func (cache *HTTPCache) CollectGarbage(path string, rateLimit int) (GCReport, error) {
+	report := GCReport{}
+
+	// Files are listed before looking at the entries so the ones stored
+	// meanwhile are seen as used
+	files, err := storage.ListFiles(path)
+	if err != nil {
+		return report, err
+	}
+	used := cache.storedFiles()
+
+	for _, file := range files {
+		if used[file.Name] || !isGarbage(file) {
+			continue
+		}
+
+		// A closed cache does not know which files the new one uses
+		var err error
+		if !cache.whileOpen(func() { err = storage.RemoveFile(file.Name) }) {
+			break
+		}
+		if err != nil {
+			continue
+		}
+		report.Files++
+		report.Bytes += file.Size
+
+		if rateLimit > 0 {
+			time.Sleep(time.Second / time.Duration(rateLimit))
+		}
+	}
+
+	return report, nil
+}
+
+// isGarbage returns if a file not used by the cache can be removed
+func isGarbage(file storage.StoredFile) bool {
+	if file.Metadata != nil {
+		metadata := entryMetadata{}
+		if err := json.Unmarshal(file.Metadata, &metadata); err == nil && metadata.StoredUntil.Before(now()) {
+			return true
+		}
+	}
+
+	return time.Since(file.ModTime) > gcGracePeriod
+}
+
+// storedFiles returns the names of the files used by the entries
+func (cache *HTTPCache) storedFiles() map[string]bool {
+	files := map[string]bool{}
+
+	for bucket := 0; bucket < cacheBucketsSize; bucket++ {
+		cache.entriesLock[bucket].RLock()
+		for _, entries := range cache.entries[bucket] {
+			for _, entry := range entries {
+				// Private entries never have a file and their body is set after they are stored
+				if !entry.isPublic {
+					continue
+				}
+				if file, ok := entry.Response.body.(*storage.FileStorage); ok {
+					files[file.Name()] = true
+				}
+			}
+		}
+		cache.entriesLock[bucket].RUnlock()
+	}
+
+	return files
+}
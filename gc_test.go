@@ -0,0 +1,63 @@
+package cache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/nicolasazrak/caddy-cache/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddy-cache-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := emptyConfig()
+	config.Path = dir
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Write([]byte("used"))
+		return 200, nil
+	}), config)
+
+	_, err = doRequestTo(t, "http://example.com/used", h)
+	require.NoError(t, err)
+
+	orphan, _ := storage.NewFileStorage(dir)
+	orphan.Write([]byte("orphan"))
+	orphan.Close()
+	old := time.Now().Add(-2 * gcGracePeriod)
+	os.Chtimes(orphan.(*storage.FileStorage).Name(), old, old)
+	for name := range h.Cache.storedFiles() {
+		os.Chtimes(name, old, old)
+	}
+
+	expired, _ := storage.NewFileStorage(dir)
+	expired.Write([]byte("expired"))
+	expired.Close()
+	metadata, _ := json.Marshal(entryMetadata{StoredUntil: time.Now().Add(-time.Minute)})
+	expired.(*storage.FileStorage).SaveMetadata(metadata)
+
+	recent, _ := storage.NewFileStorage(dir)
+	recent.Write([]byte("recent"))
+
+	report, err := h.Cache.CollectGarbage(dir, 1000)
+	require.NoError(t, err)
+	require.Equal(t, GCReport{Files: 2, Bytes: int64(len("orphan") + len("expired"))}, report)
+
+	files, err := storage.ListFiles(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+
+	h.Cache.Close()
+	os.Chtimes(recent.(*storage.FileStorage).Name(), old, old)
+	report, err = h.Cache.CollectGarbage(dir, 0)
+	require.NoError(t, err)
+	require.Equal(t, 0, report.Files, "a closed cache must not remove files")
+}
@@ -4,6 +4,9 @@ import (
 	"context"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/caddyserver/caddy"
 	"github.com/caddyserver/caddy/caddyhttp/httpserver"
@@ -22,13 +25,19 @@ type Handler struct {
 
 	// Handles locking for different URLs
 	URLLocks *URLLock
+
+	// Metrics of the cache behavior
+	Metrics *Metrics
 }
 
 const (
-	cacheHit    = "hit"
-	cacheMiss   = "miss"
-	cacheSkip   = "skip"
-	cacheBypass = "bypass"
+	cacheHit         = "hit"
+	cacheMiss        = "miss"
+	cacheSkip        = "skip"
+	cacheBypass      = "bypass"
+	cacheRevalidated = "revalidated"
+	cacheStale       = "stale"
+	cacheStaleError  = "stale-if-error"
 )
 
 var (
@@ -43,16 +52,19 @@ var (
 	}
 )
 
-func getKey(cacheKeyTemplate string, r *http.Request) string {
-	return httpserver.NewReplacer(r, nil, "").Replace(cacheKeyTemplate)
+// getKey builds the cache key of a request from the template
+// The URL is normalized first if a normalization is given
+func getKey(cacheKeyTemplate string, normalization *KeyNormalization, r *http.Request) string {
+	return httpserver.NewReplacer(normalization.normalize(r), nil, "").Replace(cacheKeyTemplate)
 }
 
 // NewHandler creates a new Handler using Next middleware
 func NewHandler(Next httpserver.Handler, config *Config) *Handler {
 	return &Handler{
 		Config:   config,
-		Cache:    NewHTTPCache(config.CacheKeyTemplate),
+		Cache:    NewHTTPCache(config.CacheKeyTemplate, config.KeyNormalization, config.MaxEntries, config.MaxDiskSize, config.MaxMemorySize),
 		URLLocks: NewURLLock(),
+		Metrics:  NewMetrics(config.MetricsGroup, config.SiteHost),
 		Next:     Next,
 	}
 }
@@ -77,34 +89,83 @@ func (handler *Handler) addStatusHeaderIfConfigured(w http.ResponseWriter, statu
 	}
 }
 
-func (handler *Handler) respond(w http.ResponseWriter, entry *HTTPCacheEntry, cacheStatus string) (int, error) {
+func (handler *Handler) respond(w http.ResponseWriter, r *http.Request, entry *HTTPCacheEntry, cacheStatus string) (int, error) {
 	handler.addStatusHeaderIfConfigured(w, cacheStatus)
+	handler.Metrics.observeRequest(r, cacheStatus)
+
+	copyHeaders(handler.servedHeaders(r, entry, cacheStatus), w.Header())
+	handler.addCacheHeaders(w, entry, cacheStatus)
+
+	// Tags are only meant for the cache
+	if handler.Config.TagHeader != "" {
+		w.Header().Del(handler.Config.TagHeader)
+	}
+
+	// The body of public responses is already stored so it does
+	// not need to be sent if the client has an up to date copy
+	if entry.isPublic && clientNotModified(r, entry.Response.Code, entry.Response.snapHeader) {
+		writeNotModified(w)
+		return http.StatusNotModified, nil
+	}
+
+	if servedFrom(cacheStatus) == servedFromCache {
+		atomic.AddUint64(&entry.Response.hits, 1)
+	}
+
+	// Private bodies are still sent because upstream is writing them to the client
+	if entry.isPublic && isHeadRequest(r) {
+		return respondHead(w, entry)
+	}
+
+	counter := &countingWriter{ResponseWriter: w}
+	defer func() {
+		handler.Metrics.observeServedBytes(r, servedFrom(cacheStatus), counter.written)
+	}()
+
+	if ranges, size, ok := entry.requestedRanges(r); ok {
+		return entry.writeRangesTo(counter, ranges, size)
+	}
 
-	copyHeaders(entry.Response.snapHeader, w.Header())
 	w.WriteHeader(entry.Response.Code)
 
-	err := entry.WriteBodyTo(w)
+	err := entry.WriteBodyTo(counter)
 
 	return entry.Response.Code, err
 }
 
+// servedFrom returns where the body of a response with the given status comes from
+func servedFrom(cacheStatus string) string {
+	switch cacheStatus {
+	case cacheMiss, cacheSkip:
+		return servedFromUpstream
+	}
+	return servedFromCache
+}
+
+// markBypass adds the headers of a request that does not use the cache
+// The name of the bypass rule that matched is only added to the placeholder
+func (handler *Handler) markBypass(w http.ResponseWriter, r *http.Request, rule *BypassRule) {
+	handler.addStatusHeaderIfConfigured(w, cacheBypass)
+	if rec, ok := w.(*httpserver.ResponseRecorder); ok && rule != nil && rec.Replacer != nil {
+		rec.Replacer.Set("cache_status", cacheBypass+":"+rule.Name)
+	}
+
+	handler.Metrics.observeRequest(r, cacheBypass)
+	handler.addVia(w)
+	if handler.Config.CacheStatusName != "" {
+		w.Header().Add(cacheStatusHeader, handler.cacheStatus(nil, cacheBypass))
+	}
+}
+
 /* Handler */
 
 func shouldUseCache(req *http.Request) bool {
-	// TODO Add more logic like get params, ?nocache=true
-
+	// Other conditions are configured with bypass rules
 	if req.Method != "GET" && req.Method != "HEAD" {
 		// Only cache Get and head request
 		return false
 	}
 
-	// Range requests still not supported
-	// It may happen that the previous request for this url has a successful response
-	// but for another Range. So a special handling is needed
-	if req.Header.Get("range") != "" {
-		return false
-	}
-
 	if isWebSocket(req.Header) {
 		return false
 	}
@@ -120,7 +181,23 @@ func popOrNil(errChan chan error) (err error) {
 	return
 }
 
-func (handler *Handler) fetchUpstream(req *http.Request) (*HTTPCacheEntry, error) {
+// storableRequest returns a copy of the request without the Range and the client
+// validators. Upstream has to send the whole body so it can be stored, instead of a
+// partial response or a 304. The client request is answered from the stored entry
+func storableRequest(req *http.Request) *http.Request {
+	storable := req.WithContext(req.Context())
+	storable.Header = http.Header{}
+	copyHeaders(req.Header, storable.Header)
+	for _, name := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"} {
+		storable.Header.Del(name)
+	}
+	return storable
+}
+
+// fetchUpstream sends the request to the next handler. With wholeBody the Range headers
+// and the client validators are removed so the response can be stored, otherwise the
+// request is sent as it is
+func (handler *Handler) fetchUpstream(req *http.Request, wholeBody bool) (*HTTPCacheEntry, error) {
 	// Create a new empty response
 	response := NewResponse()
 
@@ -146,6 +223,9 @@ func (handler *Handler) fetchUpstream(req *http.Request) (*HTTPCacheEntry, error
 		}
 
 		updatedReq := req.WithContext(updatedContext)
+		if wholeBody {
+			updatedReq = storableRequest(updatedReq)
+		}
 
 		statusCode, upstreamError := handler.Next.ServeHTTP(response, updatedReq)
 		errChan <- upstreamError
@@ -164,39 +244,262 @@ func (handler *Handler) fetchUpstream(req *http.Request) (*HTTPCacheEntry, error
 	}(req, response)
 
 	// Wait headers to be sent
+	start := time.Now()
 	response.WaitHeaders()
+	handler.Metrics.observeUpstreamLatency(req, time.Since(start))
 
 	// Create a new CacheEntry
-	return NewHTTPCacheEntry(getKey(handler.Config.CacheKeyTemplate, req), req, response, handler.Config), popOrNil(errChan)
+	return NewHTTPCacheEntry(getKey(handler.Config.CacheKeyTemplate, handler.Config.KeyNormalization, req), req, response, handler.Config), popOrNil(errChan)
+}
+
+// revalidate sends a conditional request upstream using the validators of a stale entry.
+// If upstream responds 304 Not Modified it returns a refreshed entry that reuses the stored
+// body and true. Otherwise it returns the new upstream response as a regular entry and false.
+// A nil entry without error means the refreshed entry is not cacheable anymore.
+func (handler *Handler) revalidate(r *http.Request, stale *HTTPCacheEntry) (*HTTPCacheEntry, bool, error) {
+	conditionalReq := storableRequest(r)
+
+	if etag := stale.Response.snapHeader.Get("ETag"); etag != "" {
+		conditionalReq.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := stale.Response.snapHeader.Get("Last-Modified"); lastModified != "" {
+		conditionalReq.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	// The request is already storable and only has the validators of the stale entry
+	entry, err := handler.fetchUpstream(conditionalReq, false)
+	entry.Request = r
+	if err != nil || entry.Response.Code != http.StatusNotModified {
+		return entry, false, err
+	}
+
+	// There is nothing to store from a 304, the body is taken from the stale entry
+	entry.Response.SetBody(nil)
+
+	revalidated := NewHTTPCacheEntry(stale.Key(), r, stale.Response.revalidated(entry.Response), handler.Config)
+	if !revalidated.isPublic {
+		return nil, false, nil
+	}
+
+	return revalidated, true, nil
+}
+
+// refreshInBackground updates a stale entry without making the client wait for it.
+// Only one refresh per key runs at the same time, meanwhile the stale entry is served
+func (handler *Handler) refreshInBackground(r *http.Request, stale *HTTPCacheEntry) {
+	key := stale.Key()
+	if !handler.URLLocks.StartRefresh(key) {
+		return
+	}
+
+	// The replacer of the request is left out of the context because other
+	// middlewares keep using it after the stale response is sent
+	r = r.WithContext(context.WithValue(r.Context(), httpserver.ReplacerCtxKey, nil))
+
+	go func() {
+		defer handler.URLLocks.EndRefresh(key)
+
+		if stale.canRevalidate() {
+			entry, revalidated, err := handler.revalidate(r, stale)
+			if err != nil {
+				entry.Response.SetBody(nil)
+				return
+			}
+
+			if revalidated {
+				handler.Cache.Put(r, entry)
+				return
+			}
+
+			if entry != nil {
+				handler.storeInBackground(r, entry)
+				return
+			}
+		}
+
+		entry, err := handler.fetchUpstream(r, true)
+		if err != nil {
+			entry.Response.SetBody(nil)
+			return
+		}
+
+		handler.storeInBackground(r, entry)
+	}()
+}
+
+// storeInBackground saves an entry that was fetched without a client waiting for it
+func (handler *Handler) storeInBackground(r *http.Request, entry *HTTPCacheEntry) {
+	// There is nobody to send a private body to
+	if !entry.isPublic {
+		entry.Response.SetBody(nil)
+		handler.Cache.Put(r, entry)
+		return
+	}
+
+	if err := entry.setStorage(handler.Config); err != nil {
+		return
+	}
+
+	handler.Cache.Put(r, entry)
+}
+
+// upstreamFailed returns if the upstream response can be replaced by a stale one
+// because there was an error or upstream is having problems
+func upstreamFailed(entry *HTTPCacheEntry, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	if entry == nil {
+		return false
+	}
+
+	switch entry.Response.Code {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+// respondStaleIfError discards the failed upstream response and serves the stale entry instead
+func (handler *Handler) respondStaleIfError(w http.ResponseWriter, r *http.Request, stale *HTTPCacheEntry, failed *HTTPCacheEntry, lock *sync.Mutex) (int, error) {
+	failed.Response.SetBody(nil)
+	lock.Unlock()
+	return handler.respond(w, r, stale, cacheStaleError)
+}
+
+func (handler *Handler) storeAndRespond(w http.ResponseWriter, r *http.Request, entry *HTTPCacheEntry, lock *sync.Mutex) (int, error) {
+	// Entry is always saved, even if it is not public
+	// This is to release the URL lock.
+	if entry.isPublic {
+		err := entry.setStorage(handler.Config)
+		if err != nil {
+			lock.Unlock()
+			return 500, err
+		}
+	}
+
+	handler.Cache.Put(r, entry)
+	lock.Unlock()
+	return handler.respond(w, r, entry, cacheMiss)
 }
 
 func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	if handler.isPurge(r) {
+		return handler.purge(w, r)
+	}
+
+	if handler.Config.MetricsPath != "" && r.URL.Path == handler.Config.MetricsPath {
+		return handler.serveMetrics(w, r)
+	}
+
+	if handler.Config.AdminPath != "" && r.URL.Path == handler.Config.AdminPath {
+		return handler.serveAdmin(w, r)
+	}
+
 	if !shouldUseCache(r) {
-		handler.addStatusHeaderIfConfigured(w, cacheBypass)
+		handler.markBypass(w, r, nil)
+		if !isSafeMethod(r.Method) {
+			return handler.serveUnsafe(w, r)
+		}
 		return handler.Next.ServeHTTP(w, r)
 	}
 
-	lock := handler.URLLocks.Adquire(getKey(handler.Config.CacheKeyTemplate, r))
+	if rule := handler.matchingBypassRule(r); rule != nil {
+		handler.markBypass(w, r, rule)
+		return handler.Next.ServeHTTP(w, r)
+	}
+
+	directives := handler.requestDirectives(r)
+
+	// A HEAD request can be answered with the headers of a stored GET response
+	if r.Method == "HEAD" {
+		if entry, ok := handler.freshGetEntry(r, directives); ok {
+			return handler.respond(w, r, entry, cacheHit)
+		}
+		if handler.Config.HeadAsGet {
+			r = headAsGet(r)
+		}
+	}
+
+	lockStart := now()
+	lock := handler.URLLocks.Adquire(getKey(handler.Config.CacheKeyTemplate, handler.Config.KeyNormalization, r))
+	handler.Metrics.observeLockWait(r, now().Sub(lockStart))
 
 	// Lookup correct entry
 	previousEntry, exists := handler.Cache.Get(r)
 
 	// First case: CACHE HIT
-	// The response exists in cache and is public
+	// The response exists in cache, is public and fresh
 	// It should be served as saved
-	if exists && previousEntry.isPublic {
+	if exists && previousEntry.isPublic && previousEntry.Fresh() && directives.acceptsFresh(previousEntry) {
 		lock.Unlock()
-		return handler.respond(w, previousEntry, cacheHit)
+
+		// It was stored by another request while this one waited for the lock
+		if previousEntry.storedAt.After(lockStart) {
+			handler.Metrics.observeCollapsed(r)
+		}
+		return handler.respond(w, r, previousEntry, cacheHit)
+	}
+
+	// Second case: CACHE STALE
+	// The response is in cache and is public but it is stale
+	// It is still allowed to be served while it is refreshed in background
+	// or the client accepts it stale with max-stale
+	if exists && ((previousEntry.canServeStale() && directives.allowsStaleWhileRevalidate()) || directives.acceptsStale(previousEntry)) {
+		lock.Unlock()
+		handler.refreshInBackground(r, previousEntry)
+		return handler.respond(w, r, previousEntry, cacheStale)
 	}
 
-	// Second case: CACHE SKIP
+	// The client sent only-if-cached and there is not a response it accepts
+	if directives.onlyCached() {
+		lock.Unlock()
+		handler.Metrics.observeRequest(r, cacheMiss)
+		return http.StatusGatewayTimeout, nil
+	}
+
+	// Third case: CACHE REVALIDATED
+	// The response is in cache and is public but it is stale
+	// A conditional request is sent upstream and if the response
+	// was not modified the saved body is served with the new headers
+	if exists && previousEntry.canRevalidate() {
+		entry, revalidated, err := handler.revalidate(r, previousEntry)
+		if upstreamFailed(entry, err) && previousEntry.canServeStaleIfError() {
+			return handler.respondStaleIfError(w, r, previousEntry, entry, lock)
+		}
+
+		if err != nil {
+			lock.Unlock()
+			return entry.Response.Code, err
+		}
+
+		if revalidated {
+			if handler.Cache.Put(r, entry) {
+				lock.Unlock()
+				return handler.respond(w, r, entry, cacheRevalidated)
+			}
+
+			// The stale entry was removed while it was revalidated
+			// and its body cleaned, so the response is fetched again
+			exists = false
+		} else if entry != nil {
+			// Upstream sent a whole new response
+			return handler.storeAndRespond(w, r, entry, lock)
+		}
+	}
+
+	// Fourth case: CACHE SKIP
 	// The response is in cache but it is not public
 	// It should NOT be served from cache
 	// It should be fetched from upstream and check the new headers
 	// To check if the new response changes to public
 	if exists && !previousEntry.isPublic {
 		lock.Unlock()
-		entry, err := handler.fetchUpstream(r)
+
+		// A private response is not stored so the client range is sent upstream
+		entry, err := handler.fetchUpstream(r, false)
 		if err != nil {
 			return entry.Response.Code, err
 		}
@@ -209,34 +512,26 @@ func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int,
 			}
 
 			handler.Cache.Put(r, entry)
-			return handler.respond(w, entry, cacheMiss)
+			return handler.respond(w, r, entry, cacheMiss)
 		}
 
-		return handler.respond(w, entry, cacheSkip)
+		return handler.respond(w, r, entry, cacheSkip)
 	}
 
-	// Third case: CACHE MISS
+	// Fifth case: CACHE MISS
 	// The response is not in cache
 	// It should be fetched from upstream and save it in cache
-	entry, err := handler.fetchUpstream(r)
+	entry, err := handler.fetchUpstream(r, true)
+	if exists && previousEntry.canServeStaleIfError() && upstreamFailed(entry, err) {
+		return handler.respondStaleIfError(w, r, previousEntry, entry, lock)
+	}
+
 	if err != nil {
 		lock.Unlock()
 		return entry.Response.Code, err
 	}
 
-	// Entry is always saved, even if it is not public
-	// This is to release the URL lock.
-	if entry.isPublic {
-		err := entry.setStorage(handler.Config)
-		if err != nil {
-			lock.Unlock()
-			return 500, err
-		}
-	}
-
-	handler.Cache.Put(r, entry)
-	lock.Unlock()
-	return handler.respond(w, entry, cacheMiss)
+	return handler.storeAndRespond(w, r, entry, lock)
 }
 
 func isWebSocket(h http.Header) bool {
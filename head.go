@@ -0,0 +1,50 @@
+package cache
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/caddyserver/caddy"
+)
+
+// headRequestCtxKey marks a HEAD request that is handled as a GET
+const headRequestCtxKey caddy.CtxKey = "cache_head_request"
+
+// isHeadRequest returns if the client does not expect a body
+func isHeadRequest(r *http.Request) bool {
+	return r.Method == "HEAD" || r.Context().Value(headRequestCtxKey) != nil
+}
+
+// headAsGet returns a GET request for the URL of a HEAD request. It is fetched
+// and stored as a regular GET so later GET requests are served from the cache
+func headAsGet(r *http.Request) *http.Request {
+	req := r.WithContext(context.WithValue(r.Context(), headRequestCtxKey, true))
+	req.Method = "GET"
+	return req
+}
+
+// freshGetEntry returns the fresh entry stored for a GET request
+// to the same URL of a HEAD request, if the client accepts it
+func (handler *Handler) freshGetEntry(r *http.Request, directives *requestDirectives) (*HTTPCacheEntry, bool) {
+	req := r.WithContext(r.Context())
+	req.Method = "GET"
+
+	entry, exists := handler.Cache.Get(req)
+	if !exists || !entry.isPublic || !entry.Fresh() || !directives.acceptsFresh(entry) {
+		return nil, false
+	}
+
+	return entry, true
+}
+
+// respondHead sends only the headers of a public entry. When the entry
+// was stored for a GET its Content-Length is the size of the stored body
+func respondHead(w http.ResponseWriter, entry *HTTPCacheEntry) (int, error) {
+	if entry.Request.Method != "HEAD" && w.Header().Get("Content-Length") == "" && entry.Response.bodyComplete() {
+		w.Header().Set("Content-Length", strconv.FormatInt(entry.Response.storedSize(), 10))
+	}
+
+	w.WriteHeader(entry.Response.Code)
+	return entry.Response.Code, nil
+}
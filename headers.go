@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+// rewritesHeaders returns if the stored headers have to be changed
+func rewritesHeaders(config *Config) bool {
+	return len(config.StripHeaders) > 0 || len(config.SetHeaders) > 0
+}
+
+// isStrippedHeader returns if the header is removed from the stored responses
+func isStrippedHeader(name string, config *Config) bool {
+	name = http.CanonicalHeaderKey(name)
+	for _, glob := range config.StripHeaders {
+		if matchGlob(http.CanonicalHeaderKey(glob), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteHeaders removes the headers configured with strip_header and sets the ones
+// configured with set_header. Their values can have request placeholders and {cache_key}
+func rewriteHeaders(headers http.Header, r *http.Request, key string, config *Config) {
+	for name := range headers {
+		if isStrippedHeader(name, config) {
+			delete(headers, name)
+		}
+	}
+
+	if len(config.SetHeaders) == 0 {
+		return
+	}
+
+	// {cache_key} is not set in the replacer because its custom replacements are shared
+	// with the replacer of the request. It is put between the replaced parts so the
+	// placeholders in the key, that can come from the client URL, are not expanded
+	replacer := httpserver.NewReplacer(r, nil, "")
+	for name, values := range config.SetHeaders {
+		replaced := make([]string, len(values))
+		for i, value := range values {
+			parts := strings.Split(value, "{cache_key}")
+			for j, part := range parts {
+				parts[j] = replacer.Replace(part)
+			}
+			replaced[i] = strings.Join(parts, key)
+		}
+		headers[name] = replaced
+	}
+}
+
+// servedHeaders returns the headers sent with a stored response. They are
+// rewritten again so the placeholders have the values of the served request
+// and entries stored with a previous configuration are changed too
+func (handler *Handler) servedHeaders(r *http.Request, entry *HTTPCacheEntry, cacheStatus string) http.Header {
+	if !entry.isPublic || servedFrom(cacheStatus) != servedFromCache || !rewritesHeaders(handler.Config) {
+		return entry.Response.snapHeader
+	}
+
+	headers := http.Header{}
+	copyHeaders(entry.Response.snapHeader, headers)
+	rewriteHeaders(headers, r, entry.Key(), handler.Config)
+	return headers
+}
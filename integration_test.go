@@ -2,15 +2,26 @@ package cache
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"io/ioutil"
 
 	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/nicolasazrak/caddy-cache/storage"
 	"github.com/stretchr/testify/require"
 )
 
@@ -30,6 +41,9 @@ func doRequestTo(t *testing.T, to string, h httpserver.Handler) (*http.Response,
 	r, urlErr := http.NewRequest("GET", to, nil)
 	require.NoError(t, urlErr)
 
+	// Caddy saves the original URL in the context and it is used for the {path} placeholder
+	r = r.WithContext(context.WithValue(r.Context(), httpserver.OriginalURLCtxKey, *r.URL))
+
 	_, err := h.ServeHTTP(w, r)
 	return w.Result(), err
 }
@@ -52,6 +66,14 @@ func requireBody(t *testing.T, r *http.Response, expectedBody []byte) {
 	require.Equal(t, expectedBody, actualBody)
 }
 
+func cachedEntry(t *testing.T, h *Handler, to string) *HTTPCacheEntry {
+	r := httptest.NewRequest("GET", to, nil)
+	r = r.WithContext(context.WithValue(r.Context(), httpserver.OriginalURLCtxKey, *r.URL))
+	entry, exists := h.Cache.Get(r)
+	require.True(t, exists)
+	return entry
+}
+
 func requestAndAssert(t *testing.T, h httpserver.Handler, headers http.Header, expectedCode int, expectedStatus string, expectedBody []byte) {
 	response, _ := doRequestWithHeaders(t, h, headers)
 	requireCode(t, response, expectedCode)
@@ -239,10 +261,11 @@ func TestPlaceholder(t *testing.T) {
 
 func TestRangeRequests(t *testing.T) {
 	content := []byte("0123456789")
-	t.Run("it should by pass cache if there is a range request", func(t *testing.T) {
+	t.Run("it should serve range requests from cache", func(t *testing.T) {
 		hits := 0
 		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
 			w.Header().Add("Cache-control", "max-age=10")
+			w.Header().Add("ETag", `"abc"`)
 			http.ServeContent(w, r, "content.txt", time.Now(), bytes.NewReader(content))
 			hits++
 			return 200, nil
@@ -251,8 +274,116 @@ func TestRangeRequests(t *testing.T) {
 		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, content)
 		requestAndAssert(t, h, http.Header{}, 200, cacheHit, content)
 		require.Equal(t, 1, hits)
-		requestAndAssert(t, h, http.Header{"Range": []string{"bytes=0-4"}}, 206, cacheBypass, []byte("01234"))
-		require.Equal(t, 2, hits)
+		requestAndAssert(t, h, http.Header{"Range": []string{"bytes=0-4"}}, 206, cacheHit, []byte("01234"))
+		requestAndAssert(t, h, http.Header{"Range": []string{"bytes=-3"}}, 206, cacheHit, []byte("789"))
+		requestAndAssert(t, h, http.Header{"Range": []string{"bytes=8-"}}, 206, cacheHit, []byte("89"))
+		requestAndAssert(t, h, http.Header{"Range": []string{"bytes=20-30"}}, 416, cacheHit, []byte{})
+		requestAndAssert(t, h, http.Header{"Range": []string{"lines=1-2"}}, 200, cacheHit, content)
+		require.Equal(t, 1, hits)
+
+		res, err := doRequestWithHeaders(t, h, http.Header{"Range": []string{"bytes=2-3"}})
+		require.NoError(t, err)
+		require.Equal(t, "bytes 2-3/10", res.Header.Get("Content-Range"))
+		require.Equal(t, "2", res.Header.Get("Content-Length"))
+	})
+
+	t.Run("it should serve many ranges as multipart", func(t *testing.T) {
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Header().Add("Cache-control", "max-age=10")
+			w.Header().Add("Content-Type", "text/plain")
+			w.Write(content)
+			return 200, nil
+		}), emptyConfig())
+
+		res, err := doRequestWithHeaders(t, h, http.Header{"Range": []string{"bytes=0-1,5-6"}})
+		require.NoError(t, err)
+		requireCode(t, res, 206)
+
+		mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+		require.NoError(t, err)
+		require.Equal(t, "multipart/byteranges", mediaType)
+
+		parts := multipart.NewReader(res.Body, params["boundary"])
+		expected := []struct{ contentRange, body string }{{"bytes 0-1/10", "01"}, {"bytes 5-6/10", "56"}}
+		for _, e := range expected {
+			part, err := parts.NextPart()
+			require.NoError(t, err)
+			require.Equal(t, e.contentRange, part.Header.Get("Content-Range"))
+			require.Equal(t, "text/plain", part.Header.Get("Content-Type"))
+			body, err := ioutil.ReadAll(part)
+			require.NoError(t, err)
+			require.Equal(t, e.body, string(body))
+		}
+		_, err = parts.NextPart()
+		require.Equal(t, io.EOF, err)
+	})
+
+	t.Run("it should fetch the whole body when a range request misses", func(t *testing.T) {
+		hits := 0
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			require.Equal(t, "", r.Header.Get("Range"))
+			w.Header().Add("Cache-control", "max-age=10")
+			w.Header().Add("ETag", `"abc"`)
+			w.Write(content)
+			hits++
+			return 200, nil
+		}), emptyConfig())
+
+		requestAndAssert(t, h, http.Header{"Range": []string{"bytes=3-5"}}, 206, cacheMiss, []byte("345"))
+		requestAndAssert(t, h, http.Header{}, 200, cacheHit, content)
+		require.Equal(t, 1, hits)
+	})
+
+	t.Run("it should send the range upstream for private responses", func(t *testing.T) {
+		ranges := []string{}
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			ranges = append(ranges, r.Header.Get("Range"))
+			w.Header().Add("Cache-control", "private")
+			http.ServeContent(w, r, "content.txt", time.Now(), bytes.NewReader(content))
+			return 200, nil
+		}), emptyConfig())
+
+		// Until the response is known to be private the whole body is fetched
+		requestAndAssert(t, h, http.Header{"Range": []string{"bytes=0-4"}}, 200, cacheMiss, content)
+		requestAndAssert(t, h, http.Header{"Range": []string{"bytes=0-4"}}, 206, cacheSkip, []byte("01234"))
+		require.Equal(t, []string{"", "bytes=0-4"}, ranges)
+	})
+
+	t.Run("it should ignore the range if If-Range does not match", func(t *testing.T) {
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Header().Add("Cache-control", "max-age=10")
+			w.Header().Add("ETag", `"abc"`)
+			w.Write(content)
+			return 200, nil
+		}), emptyConfig())
+
+		matching := http.Header{"Range": []string{"bytes=0-1"}, "If-Range": []string{`"abc"`}}
+		requestAndAssert(t, h, matching, 206, cacheMiss, []byte("01"))
+		changed := http.Header{"Range": []string{"bytes=0-1"}, "If-Range": []string{`"other"`}}
+		requestAndAssert(t, h, changed, 200, cacheHit, content)
+	})
+
+	t.Run("it should wait the bytes of a range that is still being downloaded", func(t *testing.T) {
+		firstPartSent := make(chan struct{})
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Header().Add("Cache-control", "max-age=10")
+			w.Write(content[:5])
+			w.(http.Flusher).Flush()
+			close(firstPartSent)
+			time.Sleep(time.Duration(10) * time.Millisecond)
+			w.Write(content[5:])
+			return 200, nil
+		}), emptyConfig())
+
+		firstRequestDone := make(chan struct{})
+		go func() {
+			doRequest(t, h)
+			close(firstRequestDone)
+		}()
+
+		<-firstPartSent
+		requestAndAssert(t, h, http.Header{"Range": []string{"bytes=7-8"}}, 206, cacheHit, []byte("78"))
+		<-firstRequestDone
 	})
 
 	t.Run("it should not cache 206 status", func(t *testing.T) {
@@ -265,11 +396,11 @@ func TestRangeRequests(t *testing.T) {
 			return 206, nil
 		}), emptyConfig())
 
-		requestAndAssert(t, h, http.Header{"Range": []string{"bytes=0-4"}}, 206, cacheBypass, content)
+		requestAndAssert(t, h, http.Header{"Range": []string{"bytes=0-4"}}, 206, cacheMiss, content)
 		require.Equal(t, 1, hits)
-		requestAndAssert(t, h, http.Header{}, 206, cacheMiss, content)
-		require.Equal(t, 2, hits)
 		requestAndAssert(t, h, http.Header{}, 206, cacheSkip, content)
+		require.Equal(t, 2, hits)
+		requestAndAssert(t, h, http.Header{"Range": []string{"bytes=0-4"}}, 206, cacheSkip, content)
 		require.Equal(t, 3, hits)
 	})
 
@@ -337,3 +468,1073 @@ func TestNotModifiedContent(t *testing.T) {
 	require.Equal(t, http.StatusOK, res2.StatusCode)
 	require.Equal(t, content, res2Content)
 }
+
+func TestRevalidateStaleEntry(t *testing.T) {
+	content := []byte("a large report")
+	config := emptyConfig()
+	config.DefaultMaxAge = time.Duration(10) * time.Millisecond
+	config.CacheRules = []CacheRule{&PathCacheRule{Path: "/"}}
+
+	t.Run("it should reuse the stored body if upstream responds 304", func(t *testing.T) {
+		hits := 0
+		conditionalHits := 0
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			hits++
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				conditionalHits++
+				w.Header().Set("X-Revalidated", "yes")
+				w.WriteHeader(http.StatusNotModified)
+				return http.StatusNotModified, nil
+			}
+			w.Write(content)
+			return 200, nil
+		}), config)
+
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, content)
+		requestAndAssert(t, h, http.Header{}, 200, cacheHit, content)
+		time.Sleep(time.Duration(20) * time.Millisecond)
+
+		res, err := doRequest(t, h)
+		require.NoError(t, err)
+		requireCode(t, res, 200)
+		requireStatus(t, res, cacheRevalidated)
+		requireBody(t, res, content)
+		require.Equal(t, "yes", res.Header.Get("X-Revalidated"))
+		require.Equal(t, 2, hits)
+		require.Equal(t, 1, conditionalHits)
+
+		requestAndAssert(t, h, http.Header{}, 200, cacheHit, content)
+		require.Equal(t, 2, hits)
+	})
+
+	t.Run("it should fetch the response again if the entry is purged while it is revalidated", func(t *testing.T) {
+		hits := 0
+		var h *Handler
+		h = NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			hits++
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				h.Cache.PurgeWhere(func(*HTTPCacheEntry) bool { return true }, HardPurge)
+				w.WriteHeader(http.StatusNotModified)
+				return http.StatusNotModified, nil
+			}
+			w.Write(content)
+			return 200, nil
+		}), config)
+
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, content)
+		time.Sleep(time.Duration(20) * time.Millisecond)
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, content)
+		requestAndAssert(t, h, http.Header{}, 200, cacheHit, content)
+		require.Equal(t, 3, hits)
+	})
+
+	t.Run("it should store the new response if it was modified", func(t *testing.T) {
+		hits := 0
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			hits++
+			w.Header().Set("ETag", strconv.Itoa(hits))
+			w.Write([]byte(strconv.Itoa(hits)))
+			return 200, nil
+		}), config)
+
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, []byte("1"))
+		time.Sleep(time.Duration(20) * time.Millisecond)
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, []byte("2"))
+		requestAndAssert(t, h, http.Header{}, 200, cacheHit, []byte("2"))
+		require.Equal(t, 2, hits)
+	})
+}
+
+func TestClientConditionalRequests(t *testing.T) {
+	content := []byte("abc")
+	hits := 0
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		hits++
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(content)
+		return 200, nil
+	}), emptyConfig())
+
+	requestAndAssert(t, h, http.Header{}, 200, cacheMiss, content)
+	requestAndAssert(t, h, makeHeader("If-None-Match", `"v1"`), 304, cacheHit, []byte{})
+	requestAndAssert(t, h, makeHeader("If-None-Match", `W/"v1"`), 304, cacheHit, []byte{})
+	requestAndAssert(t, h, makeHeader("If-None-Match", `"v0"`), 200, cacheHit, content)
+	require.Equal(t, 1, hits)
+
+	res, err := doRequestWithHeaders(t, h, makeHeader("If-None-Match", "*"))
+	require.NoError(t, err)
+	requireCode(t, res, 304)
+	require.Equal(t, `"v1"`, res.Header.Get("ETag"))
+	require.Equal(t, "", res.Header.Get("Content-Type"))
+}
+
+func TestClientValidatorsOnMiss(t *testing.T) {
+	content := []byte("abc")
+	hits := 0
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		hits++
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return http.StatusNotModified, nil
+		}
+		w.Write(content)
+		return 200, nil
+	}), emptyConfig())
+
+	// The whole response is fetched to store it and the client still gets a 304
+	requestAndAssert(t, h, makeHeader("If-None-Match", `"v1"`), 304, cacheMiss, []byte{})
+	requestAndAssert(t, h, makeHeader("If-None-Match", `"v1"`), 304, cacheHit, []byte{})
+	requestAndAssert(t, h, makeHeader("If-None-Match", `"v1"`), 304, cacheHit, []byte{})
+	requestAndAssert(t, h, http.Header{}, 200, cacheHit, content)
+	require.Equal(t, 1, hits)
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	config := emptyConfig()
+	config.DefaultMaxAge = time.Duration(100) * time.Millisecond
+	config.CacheRules = []CacheRule{&PathCacheRule{Path: "/"}}
+
+	waitRefresh := func(t *testing.T, h *Handler) {
+		r, err := http.NewRequest("GET", "/", nil)
+		require.NoError(t, err)
+		for i := 0; i < 100; i++ {
+			if entry, exists := h.Cache.Get(r); exists && entry.Fresh() {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatal("The entry was not refreshed")
+	}
+
+	t.Run("it should serve stale content and refresh it in background", func(t *testing.T) {
+		hits := int32(0)
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			hit := atomic.AddInt32(&hits, 1)
+			w.Header().Set("Cache-Control", "stale-while-revalidate=10")
+			w.Write([]byte(strconv.Itoa(int(hit))))
+			return 200, nil
+		}), config)
+
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, []byte("1"))
+		time.Sleep(time.Duration(120) * time.Millisecond)
+		requestAndAssert(t, h, http.Header{}, 200, cacheStale, []byte("1"))
+		waitRefresh(t, h)
+		requestAndAssert(t, h, http.Header{}, 200, cacheHit, []byte("2"))
+		require.Equal(t, int32(2), atomic.LoadInt32(&hits))
+	})
+
+	t.Run("it should use the configured default", func(t *testing.T) {
+		config := *config
+		config.StaleWhileRevalidate = time.Duration(10) * time.Second
+		hits := int32(0)
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			hit := atomic.AddInt32(&hits, 1)
+			w.Write([]byte(strconv.Itoa(int(hit))))
+			return 200, nil
+		}), &config)
+
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, []byte("1"))
+		time.Sleep(time.Duration(120) * time.Millisecond)
+		requestAndAssert(t, h, http.Header{}, 200, cacheStale, []byte("1"))
+		waitRefresh(t, h)
+		requestAndAssert(t, h, http.Header{}, 200, cacheHit, []byte("2"))
+	})
+
+	t.Run("it should not change the request replacer when setting headers in background", func(t *testing.T) {
+		config := *config
+		config.SetHeaders = http.Header{"X-Cache-Key": []string{"{cache_key}"}}
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Header().Set("Cache-Control", "stale-while-revalidate=10")
+			w.Write([]byte("abc"))
+			return 200, nil
+		}), &config)
+
+		r, err := http.NewRequest("GET", "/", nil)
+		require.NoError(t, err)
+		replacer := httpserver.NewReplacer(r, nil, "")
+		r = r.WithContext(context.WithValue(r.Context(), httpserver.ReplacerCtxKey, replacer))
+
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, []byte("abc"))
+		time.Sleep(time.Duration(120) * time.Millisecond)
+
+		w := httptest.NewRecorder()
+		_, err = h.ServeHTTP(w, r)
+		require.NoError(t, err)
+		requireStatus(t, w.Result(), cacheStale)
+
+		// Other middlewares keep using the request replacer while the entry is refreshed
+		for i := 0; i < 100; i++ {
+			replacer.Set("counter", strconv.Itoa(i))
+			require.Equal(t, "", replacer.Replace("{cache_key}"))
+		}
+		waitRefresh(t, h)
+		require.Equal(t, "", replacer.Replace("{cache_key}"))
+	})
+
+	t.Run("it should not serve stale content if it must be revalidated", func(t *testing.T) {
+		hits := int32(0)
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			hit := atomic.AddInt32(&hits, 1)
+			w.Header().Set("Cache-Control", "must-revalidate, stale-while-revalidate=10")
+			w.Write([]byte(strconv.Itoa(int(hit))))
+			return 200, nil
+		}), config)
+
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, []byte("1"))
+		time.Sleep(time.Duration(120) * time.Millisecond)
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, []byte("2"))
+	})
+}
+
+func TestStaleIfError(t *testing.T) {
+	content := []byte("abc")
+	config := emptyConfig()
+	config.DefaultMaxAge = time.Duration(10) * time.Millisecond
+	config.CacheRules = []CacheRule{&PathCacheRule{Path: "/"}}
+	badGateway := errors.New("Bad gateway")
+
+	t.Run("it should serve stale content if upstream fails", func(t *testing.T) {
+		hits := 0
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			hits++
+			switch hits {
+			case 1:
+				w.Header().Set("Cache-Control", "stale-if-error=10")
+				w.Write(content)
+				return 200, nil
+			case 2:
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return http.StatusServiceUnavailable, nil
+			default:
+				return http.StatusBadGateway, badGateway
+			}
+		}), config)
+
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, content)
+		time.Sleep(time.Duration(20) * time.Millisecond)
+		requestAndAssert(t, h, http.Header{}, 200, cacheStaleError, content)
+		requestAndAssert(t, h, http.Header{}, 200, cacheStaleError, content)
+		require.Equal(t, 3, hits)
+	})
+
+	t.Run("it should serve stale content if revalidation fails", func(t *testing.T) {
+		config := *config
+		config.StaleIfError = time.Duration(10) * time.Second
+		hits := 0
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			hits++
+			if hits > 1 {
+				return http.StatusBadGateway, badGateway
+			}
+			w.Header().Set("ETag", `"v1"`)
+			w.Write(content)
+			return 200, nil
+		}), &config)
+
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, content)
+		time.Sleep(time.Duration(20) * time.Millisecond)
+		requestAndAssert(t, h, http.Header{}, 200, cacheStaleError, content)
+	})
+
+	t.Run("it should return the error if there is no stale content", func(t *testing.T) {
+		hits := 0
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			hits++
+			if hits > 1 {
+				return http.StatusBadGateway, badGateway
+			}
+			w.Write(content)
+			return 200, nil
+		}), config)
+
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, content)
+		time.Sleep(time.Duration(20) * time.Millisecond)
+		_, err := doRequest(t, h)
+		require.Equal(t, badGateway, err)
+	})
+}
+
+func TestPurge(t *testing.T) {
+	content := []byte("abc")
+	config := emptyConfig()
+	config.PurgeMethod = "PURGE"
+	config.PurgeAllow = []*net.IPNet{mustParseNetwork("10.0.0.0/8")}
+	config.PurgeSecretHeader = "X-Purge-Token"
+	config.PurgeSecret = "s3cr3t"
+
+	purge := func(h *Handler, remoteAddr string, headers http.Header) int {
+		r, err := http.NewRequest("PURGE", "/", nil)
+		require.NoError(t, err)
+		r.RemoteAddr = remoteAddr
+		r.Header = headers
+
+		code, err := h.ServeHTTP(httptest.NewRecorder(), r)
+		require.NoError(t, err)
+		return code
+	}
+
+	hits := 0
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		hits++
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Header().Set("Vary", "Accept-Encoding")
+		w.Write(content)
+		return 200, nil
+	}), config)
+
+	gzip := http.Header{"Accept-Encoding": []string{"gzip"}}
+	requestAndAssert(t, h, gzip, 200, cacheMiss, content)
+	requestAndAssert(t, h, http.Header{}, 200, cacheMiss, content)
+	require.Equal(t, 2, hits)
+
+	require.Equal(t, http.StatusForbidden, purge(h, "192.168.0.1:1234", http.Header{}))
+	require.Equal(t, http.StatusForbidden, purge(h, "192.168.0.1:1234", makeHeader("X-Purge-Token", "wrong")))
+	requestAndAssert(t, h, gzip, 200, cacheHit, content)
+
+	require.Equal(t, http.StatusOK, purge(h, "10.0.0.1:1234", http.Header{}))
+	require.Equal(t, http.StatusNotFound, purge(h, "192.168.0.1:1234", makeHeader("X-Purge-Token", "s3cr3t")))
+
+	requestAndAssert(t, h, gzip, 200, cacheMiss, content)
+	requestAndAssert(t, h, http.Header{}, 200, cacheMiss, content)
+	require.Equal(t, 4, hits)
+}
+
+func TestPurgeTags(t *testing.T) {
+	config := emptyConfig()
+	config.PurgeMethod = "PURGE"
+	config.PurgeSecretHeader = "X-Purge-Token"
+	config.PurgeSecret = "s3cr3t"
+	config.TagHeader = "Surrogate-Key"
+
+	hits := map[string]int{}
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		hits[r.URL.Path]++
+		w.Header().Set("Cache-Control", "max-age=10")
+		switch r.URL.Path {
+		case "/product/1", "/list":
+			w.Header().Set("Surrogate-Key", "product-1 list")
+		default:
+			w.Header().Set("Surrogate-Key", "product-2")
+		}
+		w.Write([]byte(r.URL.Path))
+		return 200, nil
+	}), config)
+
+	for _, path := range []string{"/product/1", "/list", "/product/2"} {
+		res, err := doRequestTo(t, "http://example.com"+path, h)
+		require.NoError(t, err)
+		require.Equal(t, "", res.Header.Get("Surrogate-Key"))
+	}
+
+	r, err := http.NewRequest("PURGE", "/anything", nil)
+	require.NoError(t, err)
+	r.Header.Set("X-Purge-Token", "s3cr3t")
+	r.Header.Set("Surrogate-Key", "product-1")
+	code, err := h.ServeHTTP(httptest.NewRecorder(), r)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, code)
+
+	for _, path := range []string{"/product/1", "/list", "/product/2"} {
+		doRequestTo(t, "http://example.com"+path, h)
+	}
+
+	require.Equal(t, map[string]int{"/product/1": 2, "/list": 2, "/product/2": 1}, hits)
+}
+
+func TestBulkPurge(t *testing.T) {
+	config := emptyConfig()
+	config.PurgeMethod = "PURGE"
+	config.PurgeAllow = []*net.IPNet{mustParseNetwork("127.0.0.1")}
+
+	doPurge := func(h *Handler, to string, headers http.Header) (*httptest.ResponseRecorder, int) {
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest("PURGE", to, nil)
+		require.NoError(t, err)
+		r = r.WithContext(context.WithValue(r.Context(), httpserver.OriginalURLCtxKey, *r.URL))
+		r.RemoteAddr = "127.0.0.1:1234"
+		r.Header = headers
+
+		code, err := h.ServeHTTP(w, r)
+		require.NoError(t, err)
+		return w, code
+	}
+
+	paths := []string{"/api/v1/catalog/1", "/api/v1/catalog/2", "/api/v1/users/1"}
+	newHandler := func(hits map[string]int) *Handler {
+		return NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			hits[r.URL.Path]++
+			w.Header().Set("Cache-Control", "max-age=10")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return http.StatusNotModified, nil
+			}
+			w.Write([]byte(r.URL.Path))
+			return 200, nil
+		}), config)
+	}
+
+	requestAll := func(h *Handler) []string {
+		statuses := []string{}
+		for _, path := range paths {
+			res, err := doRequestTo(t, "http://example.com"+path, h)
+			require.NoError(t, err)
+			statuses = append(statuses, res.Header.Get(defaultStatusHeader))
+		}
+		return statuses
+	}
+
+	t.Run("it should purge by path prefix", func(t *testing.T) {
+		hits := map[string]int{}
+		h := newHandler(hits)
+		requestAll(h)
+
+		_, code := doPurge(h, "http://example.com/api/v1/catalog/*", http.Header{})
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, []string{cacheMiss, cacheMiss, cacheHit}, requestAll(h))
+	})
+
+	t.Run("it should purge by regular expression", func(t *testing.T) {
+		h := newHandler(map[string]int{})
+		requestAll(h)
+
+		_, code := doPurge(h, "http://example.com/", makeHeader(purgeRegexHeader, "/1\\?$"))
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, []string{cacheMiss, cacheHit, cacheMiss}, requestAll(h))
+
+		_, code = doPurge(h, "http://example.com/", makeHeader(purgeRegexHeader, "(invalid"))
+		require.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("it should only report the matches in a dry run", func(t *testing.T) {
+		h := newHandler(map[string]int{})
+		requestAll(h)
+
+		w, code := doPurge(h, "http://example.com/api/v1/catalog/*", makeHeader(purgeDryRunHeader, "true"))
+		require.Equal(t, http.StatusOK, code)
+		require.JSONEq(t, `{"count": 2, "keys": ["GET example.com/api/v1/catalog/1?", "GET example.com/api/v1/catalog/2?"]}`, w.Body.String())
+		require.Equal(t, []string{cacheHit, cacheHit, cacheHit}, requestAll(h))
+	})
+
+	t.Run("it should mark the entries as stale in a soft purge", func(t *testing.T) {
+		hits := map[string]int{}
+		h := newHandler(hits)
+		requestAll(h)
+
+		_, code := doPurge(h, "http://example.com/api/v1/users/1", makeHeader(purgeSoftHeader, "true"))
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, []string{cacheHit, cacheHit, cacheRevalidated}, requestAll(h))
+		require.Equal(t, []string{cacheHit, cacheHit, cacheHit}, requestAll(h))
+		require.Equal(t, 2, hits["/api/v1/users/1"])
+	})
+}
+
+func TestEviction(t *testing.T) {
+	hits := map[string]int{}
+	config := emptyConfig()
+	config.MaxEntries = 2
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		hits[r.URL.Path]++
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Write([]byte(r.URL.Path))
+		return 200, nil
+	}), config)
+
+	requestStatus := func(path string) string {
+		res, err := doRequestTo(t, "http://example.com"+path, h)
+		require.NoError(t, err)
+		return res.Header.Get(defaultStatusHeader)
+	}
+
+	require.Equal(t, cacheMiss, requestStatus("/a"))
+	require.Equal(t, cacheMiss, requestStatus("/b"))
+	require.Equal(t, cacheHit, requestStatus("/a"))
+	require.Equal(t, cacheMiss, requestStatus("/c"))
+
+	// /b was the least recently used one
+	require.Equal(t, cacheHit, requestStatus("/a"))
+	require.Equal(t, cacheMiss, requestStatus("/b"))
+	require.Equal(t, 2, h.Cache.lru.len())
+}
+
+func TestEvictionWithPrivateEntries(t *testing.T) {
+	hits := map[string]int{}
+	config := emptyConfig()
+	config.MaxEntries = 1
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		hits[r.URL.Path]++
+		if r.URL.Path == "/private" {
+			w.Header().Set("Cache-Control", "private")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=10")
+		}
+		w.Write([]byte(r.URL.Path))
+		return 200, nil
+	}), config)
+
+	requestStatus := func(path string) string {
+		res, err := doRequestTo(t, "http://example.com"+path, h)
+		require.NoError(t, err)
+		return res.Header.Get(defaultStatusHeader)
+	}
+
+	require.Equal(t, cacheMiss, requestStatus("/public"))
+	require.Equal(t, cacheMiss, requestStatus("/private"))
+	require.Equal(t, cacheSkip, requestStatus("/private"))
+	require.Equal(t, cacheHit, requestStatus("/public"))
+	require.Equal(t, 1, hits["/public"])
+	require.Equal(t, 1, h.Cache.lru.len())
+}
+
+func TestMemoryStorage(t *testing.T) {
+	config := emptyConfig()
+	config.Storage = memoryStorage
+	config.MemoryStorageMaxSize = 10
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		body := []byte(r.URL.Path)
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write(body)
+		return 200, nil
+	}), config)
+
+	for _, path := range []string{"/small", "/a-larger-path"} {
+		res, err := doRequestTo(t, "http://example.com"+path, h)
+		require.NoError(t, err)
+		require.Equal(t, cacheMiss, res.Header.Get(defaultStatusHeader))
+
+		res, err = doRequestTo(t, "http://example.com"+path, h)
+		require.NoError(t, err)
+		require.Equal(t, cacheHit, res.Header.Get(defaultStatusHeader))
+		body, _ := ioutil.ReadAll(res.Body)
+		require.Equal(t, path, string(body))
+	}
+
+	require.False(t, cachedEntry(t, h, "http://example.com/small").Response.storedOnDisk())
+	require.True(t, cachedEntry(t, h, "http://example.com/a-larger-path").Response.storedOnDisk())
+}
+
+func TestMaxMemorySize(t *testing.T) {
+	config := emptyConfig()
+	config.Storage = memoryStorage
+	config.MaxMemorySize = 10
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Write([]byte(r.URL.Path))
+		return 200, nil
+	}), config)
+
+	requestStatus := func(path string) string {
+		res, err := doRequestTo(t, "http://example.com"+path, h)
+		require.NoError(t, err)
+		return res.Header.Get(defaultStatusHeader)
+	}
+
+	// The size is accounted and the entries evicted in background once the whole body is stored
+	waitEvictions := func(evictions uint64, size int64) {
+		for i := 0; i < 100 && (atomic.LoadUint64(&h.Cache.evictions) != evictions || h.Cache.lru.memory() != size); i++ {
+			time.Sleep(time.Millisecond)
+		}
+		require.Equal(t, evictions, atomic.LoadUint64(&h.Cache.evictions))
+		require.Equal(t, size, h.Cache.lru.memory())
+	}
+
+	require.Equal(t, cacheMiss, requestStatus("/first"))
+	waitEvictions(0, 6)
+	require.Equal(t, cacheMiss, requestStatus("/second"))
+	waitEvictions(1, 7)
+
+	require.Equal(t, cacheHit, requestStatus("/second"))
+	require.Equal(t, cacheMiss, requestStatus("/first"))
+	waitEvictions(2, 6)
+}
+
+func TestRestorePersistedEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddy-cache-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	hits := 0
+	upstream := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		hits++
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Header().Set("Vary", "Accept-Encoding")
+		w.Write([]byte("persisted"))
+		return 200, nil
+	})
+
+	config := emptyConfig()
+	config.Path = dir
+
+	h := NewHandler(upstream, config)
+	restored, err := h.Cache.Restore(dir)
+	require.NoError(t, err)
+	require.Equal(t, 0, restored)
+
+	res, err := doRequestTo(t, "http://example.com/a", h)
+	require.NoError(t, err)
+	requireStatus(t, res, cacheMiss)
+
+	// Expired and corrupt entries must not be restored
+	expired, _ := storage.NewFileStorage(dir)
+	expired.Write([]byte("x"))
+	expired.Close()
+	metadata, _ := json.Marshal(entryMetadata{
+		Key:         "GET example.com/expired?",
+		Method:      "GET",
+		URL:         "http://example.com/expired",
+		StoredUntil: time.Now().Add(-time.Minute),
+		BodySize:    1,
+	})
+	expired.(*storage.FileStorage).SaveMetadata(metadata)
+
+	corrupt, _ := storage.NewFileStorage(dir)
+	corrupt.Close()
+	corrupt.(*storage.FileStorage).SaveMetadata([]byte("{"))
+
+	time.Sleep(time.Duration(20) * time.Millisecond)
+	storedAt := cachedEntry(t, h, "http://example.com/a").storedAt
+	h.Cache.Close()
+
+	h = NewHandler(upstream, config)
+	restored, err = h.Cache.Restore(dir)
+	require.NoError(t, err)
+	require.Equal(t, 1, restored)
+
+	res, err = doRequestTo(t, "http://example.com/a", h)
+	require.NoError(t, err)
+	requireStatus(t, res, cacheHit)
+	body, _ := ioutil.ReadAll(res.Body)
+	require.Equal(t, "persisted", string(body))
+	require.True(t, storedAt.Equal(cachedEntry(t, h, "http://example.com/a").storedAt), "the stored time is kept so the Age is right")
+	require.Equal(t, 1, hits)
+
+	files, err := storage.ListFiles(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+}
+
+func TestRestoreClosesPreviousCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddy-cache-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	upstream := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Write([]byte("persisted"))
+		return 200, nil
+	})
+
+	config := emptyConfig()
+	config.Path = dir
+
+	old := NewHandler(upstream, config)
+	_, err = old.Cache.Restore(dir)
+	require.NoError(t, err)
+	res, err := doRequestTo(t, "http://example.com/a", old)
+	require.NoError(t, err)
+	requireStatus(t, res, cacheMiss)
+	time.Sleep(time.Duration(20) * time.Millisecond)
+
+	// On a reload the new instance starts before the old one is stopped
+	h := NewHandler(upstream, config)
+	restored, err := h.Cache.Restore(dir)
+	require.NoError(t, err)
+	require.Equal(t, 1, restored)
+
+	old.Cache.PurgeWhere(func(*HTTPCacheEntry) bool { return true }, HardPurge)
+	time.Sleep(time.Duration(20) * time.Millisecond)
+	old.Cache.Close()
+
+	res, err = doRequestTo(t, "http://example.com/a", h)
+	require.NoError(t, err)
+	requireStatus(t, res, cacheHit)
+	requireBody(t, res, []byte("persisted"))
+	h.Cache.Close()
+}
+
+func TestMetrics(t *testing.T) {
+	config := emptyConfig()
+	config.MetricsPath = "/metrics"
+	config.MetricsGroup = "assets"
+	config.SiteHost = "example.com"
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Write([]byte("hello"))
+		return 200, nil
+	}), config)
+
+	for i := 0; i < 3; i++ {
+		_, err := doRequestTo(t, "http://example.com:8080/a", h)
+		require.NoError(t, err)
+	}
+	_, err := doRequestTo(t, "http://unknown.example.org/a", h)
+	require.NoError(t, err)
+
+	res, err := doRequestTo(t, "http://example.com/metrics", h)
+	require.NoError(t, err)
+	requireCode(t, res, 200)
+	body, _ := ioutil.ReadAll(res.Body)
+
+	require.Contains(t, string(body), `caddy_cache_requests_total{group="assets",host="example.com",status="miss"} 1`)
+	require.Contains(t, string(body), `caddy_cache_requests_total{group="assets",host="other",status="miss"} 1`)
+	require.NotContains(t, string(body), "unknown.example.org")
+	require.Contains(t, string(body), `caddy_cache_requests_total{group="assets",host="example.com",status="hit"} 2`)
+	require.Contains(t, string(body), `caddy_cache_served_bytes_total{group="assets",host="example.com",source="cache"} 10`)
+	require.Contains(t, string(body), `caddy_cache_served_bytes_total{group="assets",host="example.com",source="upstream"} 5`)
+	require.Contains(t, string(body), `caddy_cache_upstream_duration_seconds_count{group="assets",host="example.com"} 1`)
+	require.Contains(t, string(body), `caddy_cache_lock_wait_seconds_bucket{group="assets",host="example.com",le="+Inf"} 3`)
+	require.Contains(t, string(body), `caddy_cache_entries{group="assets"} 2`)
+	require.Contains(t, string(body), `caddy_cache_evictions_total{group="assets"} 0`)
+}
+
+func TestAdmin(t *testing.T) {
+	config := emptyConfig()
+	config.AdminPath = "/cache-admin"
+	config.AdminAllow = []*net.IPNet{mustParseNetwork("10.0.0.0/8")}
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Header().Set("Vary", "Accept-Encoding")
+		w.Write([]byte("hello"))
+		return 200, nil
+	}), config)
+
+	admin := func(remoteAddr string, query string) (int, []byte) {
+		r, err := http.NewRequest("GET", "http://example.com/cache-admin?"+query, nil)
+		require.NoError(t, err)
+		r.RemoteAddr = remoteAddr
+
+		w := httptest.NewRecorder()
+		code, err := h.ServeHTTP(w, r)
+		require.NoError(t, err)
+		return code, w.Body.Bytes()
+	}
+
+	for _, path := range []string{"/a", "/a", "/b"} {
+		_, err := doRequestTo(t, "http://example.com"+path, h)
+		require.NoError(t, err)
+	}
+
+	code, _ := admin("192.168.0.1:1234", "")
+	require.Equal(t, http.StatusForbidden, code)
+
+	code, body := admin("10.0.0.1:1234", "prefix="+url.QueryEscape("GET example.com/a"))
+	require.Equal(t, http.StatusOK, code)
+	page := adminPage{}
+	require.NoError(t, json.Unmarshal(body, &page))
+	require.Len(t, page.Entries, 1)
+	require.Equal(t, "GET example.com/a?", page.Entries[0].Key)
+	require.Equal(t, 200, page.Entries[0].Variants[0].Status)
+	require.Equal(t, int64(5), page.Entries[0].Variants[0].Size)
+	require.Equal(t, uint64(1), page.Entries[0].Variants[0].Hits)
+	require.True(t, page.Entries[0].Variants[0].Public)
+	require.Nil(t, page.Entries[0].Variants[0].Headers)
+
+	// Pages stop after the bucket where the limit is reached
+	code, body = admin("10.0.0.1:1234", "limit=1")
+	require.Equal(t, http.StatusOK, code)
+	page = adminPage{}
+	require.NoError(t, json.Unmarshal(body, &page))
+	require.Len(t, page.Entries, 1)
+	require.NotNil(t, page.NextCursor)
+
+	code, body = admin("10.0.0.1:1234", "limit=1&cursor="+strconv.Itoa(*page.NextCursor))
+	require.Equal(t, http.StatusOK, code)
+	page = adminPage{}
+	require.NoError(t, json.Unmarshal(body, &page))
+	require.Len(t, page.Entries, 1)
+
+	code, body = admin("10.0.0.1:1234", "key="+url.QueryEscape("GET example.com/b?"))
+	require.Equal(t, http.StatusOK, code)
+	entry := adminEntry{}
+	require.NoError(t, json.Unmarshal(body, &entry))
+	require.Equal(t, "max-age=10", entry.Variants[0].Headers.Get("Cache-Control"))
+
+	code, _ = admin("10.0.0.1:1234", "key=missing")
+	require.Equal(t, http.StatusNotFound, code)
+
+	code, _ = admin("10.0.0.1:1234", "cursor=256")
+	require.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestRequestCacheControl(t *testing.T) {
+	content := []byte("abc")
+	hits := int32(0)
+	newHandler := func(config *Config) *Handler {
+		return NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			atomic.AddInt32(&hits, 1)
+			w.Header().Set("Cache-Control", "max-age=10")
+			w.Header().Set("ETag", `"v1"`) // Stale entries are only kept if they can be revalidated
+			w.Write(content)
+			return 200, nil
+		}), config)
+	}
+	cacheControl := func(value string) http.Header {
+		return http.Header{"Cache-Control": []string{value}}
+	}
+
+	// Upstream expirations are computed with the real clock so each test starts with it
+	t.Run("no-cache and max-age skip fresh entries", func(t *testing.T) {
+		clock := useFakeClock()
+		defer clock.restore()
+
+		h := newHandler(emptyConfig())
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, content)
+		requestAndAssert(t, h, cacheControl("no-cache"), 200, cacheMiss, content)
+		requestAndAssert(t, h, http.Header{"Pragma": []string{"no-cache"}}, 200, cacheMiss, content)
+
+		clock.Advance(time.Duration(5) * time.Second)
+		requestAndAssert(t, h, cacheControl("max-age=3"), 200, cacheMiss, content)
+		requestAndAssert(t, h, cacheControl("max-age=3"), 200, cacheHit, content)
+		requestAndAssert(t, h, cacheControl("min-fresh=20"), 200, cacheMiss, content)
+	})
+
+	t.Run("max-stale serves stale entries", func(t *testing.T) {
+		clock := useFakeClock()
+		defer clock.restore()
+
+		h := newHandler(emptyConfig())
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, content)
+
+		clock.Advance(time.Duration(15) * time.Second)
+		requestAndAssert(t, h, cacheControl("max-stale=10"), 200, cacheStale, content)
+		time.Sleep(time.Duration(20) * time.Millisecond)
+
+		clock.Advance(time.Duration(15) * time.Second)
+		response, err := doRequestWithHeaders(t, h, cacheControl("max-stale=1"))
+		require.NoError(t, err)
+		require.NotEqual(t, cacheStale, response.Header.Get(defaultStatusHeader))
+	})
+
+	t.Run("only-if-cached responds 504 on miss", func(t *testing.T) {
+		h := newHandler(emptyConfig())
+		before := atomic.LoadInt32(&hits)
+
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header = cacheControl("only-if-cached")
+		code, err := h.ServeHTTP(httptest.NewRecorder(), r)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusGatewayTimeout, code)
+		require.Equal(t, before, atomic.LoadInt32(&hits))
+
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, content)
+		requestAndAssert(t, h, cacheControl("only-if-cached"), 200, cacheHit, content)
+	})
+
+	t.Run("directives from untrusted clients are ignored", func(t *testing.T) {
+		config := emptyConfig()
+		config.RequestCacheControlAllow = []*net.IPNet{mustParseNetwork("10.0.0.0/8")}
+		h := newHandler(config)
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, content)
+
+		request := func(remoteAddr string) string {
+			r, _ := http.NewRequest("GET", "/", nil)
+			r.RemoteAddr = remoteAddr
+			r.Header = cacheControl("no-cache")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			return w.Header().Get(defaultStatusHeader)
+		}
+
+		require.Equal(t, cacheHit, request("192.168.0.1:1234"))
+		require.Equal(t, cacheMiss, request("10.0.0.1:1234"))
+	})
+}
+
+func TestCacheHeaders(t *testing.T) {
+	clock := useFakeClock()
+	defer clock.restore()
+
+	config := emptyConfig()
+	config.CacheStatusName = "edge"
+	config.CacheStatusKey = true
+	config.Via = "edge-1"
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		w.Header().Set("Cache-Control", "max-age=100")
+		w.Header().Set("Age", "10")
+		w.Write([]byte("abc"))
+		return 200, nil
+	}), config)
+
+	res, err := doRequestTo(t, "http://example.com/a", h)
+	require.NoError(t, err)
+	require.Equal(t, "10", res.Header.Get("Age"))
+	require.Equal(t, "1.1 edge-1", res.Header.Get("Via"))
+	require.Equal(t, `edge; fwd=uri-miss; stored; ttl=100; key="GET example.com/a?"`, res.Header.Get(cacheStatusHeader))
+
+	clock.Advance(time.Duration(30) * time.Second)
+	res, err = doRequestTo(t, "http://example.com/a", h)
+	require.NoError(t, err)
+	require.Equal(t, "40", res.Header.Get("Age"))
+	require.Equal(t, []string{"1.1 edge-1"}, res.Header["Via"])
+	require.Equal(t, `edge; hit; ttl=70; key="GET example.com/a?"`, res.Header.Get(cacheStatusHeader))
+
+	r, _ := http.NewRequest("POST", "http://example.com/a", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal(t, "edge; fwd=bypass", w.Header().Get(cacheStatusHeader))
+}
+
+func TestInvalidateOnUnsafeMethods(t *testing.T) {
+	hits := map[string]int{}
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		if r.Method == "POST" {
+			switch r.URL.Path {
+			case "/fail":
+				return 500, nil
+			case "/created":
+				w.Header().Set("Location", "/b")
+				w.Header().Set("Content-Location", "http://other.com/c")
+				w.WriteHeader(201)
+				return 0, nil
+			}
+			return 204, nil
+		}
+
+		hits[r.URL.Path]++
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Write([]byte(r.URL.Path))
+		return 200, nil
+	}), emptyConfig())
+
+	get := func(path string) {
+		_, err := doRequestTo(t, "http://example.com"+path, h)
+		require.NoError(t, err)
+	}
+	post := func(path string) {
+		r, err := http.NewRequest("POST", "http://example.com"+path, nil)
+		require.NoError(t, err)
+		r = r.WithContext(context.WithValue(r.Context(), httpserver.OriginalURLCtxKey, *r.URL))
+		_, err = h.ServeHTTP(httptest.NewRecorder(), r)
+		require.NoError(t, err)
+	}
+
+	for _, path := range []string{"/a", "/b", "/c", "/fail", "/created"} {
+		get(path)
+	}
+
+	post("/a")
+	post("/fail")
+	post("/created")
+
+	for _, path := range []string{"/a", "/b", "/c", "/fail", "/created"} {
+		get(path)
+	}
+
+	require.Equal(t, map[string]int{"/a": 2, "/b": 2, "/c": 1, "/fail": 1, "/created": 2}, hits)
+}
+
+func TestHeadRequests(t *testing.T) {
+	methods := map[string][]string{}
+	upstream := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		methods[r.URL.Path] = append(methods[r.URL.Path], r.Method)
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Write([]byte("abc"))
+		return 200, nil
+	})
+
+	request := func(h *Handler, method string, path string) *httptest.ResponseRecorder {
+		r, err := http.NewRequest(method, "http://example.com"+path, nil)
+		require.NoError(t, err)
+		r = r.WithContext(context.WithValue(r.Context(), httpserver.OriginalURLCtxKey, *r.URL))
+		w := httptest.NewRecorder()
+		_, err = h.ServeHTTP(w, r)
+		require.NoError(t, err)
+		return w
+	}
+
+	t.Run("served from a stored GET", func(t *testing.T) {
+		h := NewHandler(upstream, emptyConfig())
+		request(h, "GET", "/a")
+
+		res := request(h, "HEAD", "/a")
+		require.Equal(t, 200, res.Code)
+		require.Equal(t, cacheHit, res.Header().Get(defaultStatusHeader))
+		require.Equal(t, "3", res.Header().Get("Content-Length"))
+		require.Equal(t, 0, res.Body.Len())
+
+		request(h, "HEAD", "/b")
+		require.Equal(t, map[string][]string{"/a": {"GET"}, "/b": {"HEAD"}}, methods)
+	})
+
+	t.Run("fetched as GET", func(t *testing.T) {
+		config := emptyConfig()
+		config.HeadAsGet = true
+		h := NewHandler(upstream, config)
+
+		res := request(h, "HEAD", "/c")
+		require.Equal(t, cacheMiss, res.Header().Get(defaultStatusHeader))
+		require.Equal(t, 0, res.Body.Len())
+
+		res = request(h, "GET", "/c")
+		require.Equal(t, cacheHit, res.Header().Get(defaultStatusHeader))
+		require.Equal(t, "abc", res.Body.String())
+		require.Equal(t, []string{"GET"}, methods["/c"])
+	})
+}
+
+func TestBypassRules(t *testing.T) {
+	config := emptyConfig()
+	config.BypassRules = []BypassRule{
+		{Name: "logged_in", Conditions: []BypassCondition{&CookieBypassCondition{Name: "session_id"}}},
+	}
+
+	hits := 0
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		hits++
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Write([]byte("page"))
+		return 200, nil
+	}), config)
+
+	requestAndAssert(t, h, http.Header{}, 200, cacheMiss, []byte("page"))
+	requestAndAssert(t, h, http.Header{}, 200, cacheHit, []byte("page"))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	require.NoError(t, err)
+	r.Header.Set("Cookie", "session_id=1")
+	rec := httpserver.NewResponseRecorder(httptest.NewRecorder())
+	rec.Replacer = httpserver.NewReplacer(r, rec, "")
+	_, err = h.ServeHTTP(rec, r)
+	require.NoError(t, err)
+
+	require.Equal(t, cacheBypass, rec.Header().Get(defaultStatusHeader))
+	require.Equal(t, "bypass:logged_in", rec.Replacer.Replace("{cache_status}"))
+	require.Equal(t, 2, hits)
+}
+
+func TestStoredHeaders(t *testing.T) {
+	config := emptyConfig()
+	config.StripHeaders = []string{"Set-Cookie", "X-Debug-*"}
+	config.SetHeaders = http.Header{"X-Cache-Key": []string{"{cache_key}"}}
+
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Header().Set("Set-Cookie", "session=1")
+		w.Header().Set("X-Debug-Backend", "db-1")
+		w.Header().Set("X-Version", "2")
+		w.Write([]byte("abc"))
+		return 200, nil
+	}), config)
+
+	for _, status := range []string{cacheMiss, cacheHit} {
+		res, err := doRequestTo(t, "http://example.com/a", h)
+		require.NoError(t, err)
+		requireStatus(t, res, status)
+		require.Equal(t, "", res.Header.Get("Set-Cookie"))
+		require.Equal(t, "", res.Header.Get("X-Debug-Backend"))
+		require.Equal(t, "2", res.Header.Get("X-Version"))
+		require.Equal(t, "GET example.com/a?", res.Header.Get("X-Cache-Key"))
+	}
+
+	t.Run("it should not expand the placeholders in the cache key", func(t *testing.T) {
+		res, err := doRequestTo(t, "http://example.com/b?q={method}", h)
+		require.NoError(t, err)
+		require.Equal(t, "GET example.com/b?q={method}", res.Header.Get("X-Cache-Key"))
+	})
+}
@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+// isSafeMethod returns if the method only retrieves the resource.
+// Requests with other methods can change it
+func isSafeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
+
+// serveUnsafe passes the request upstream and, if it succeeded, invalidates
+// the entries stored for the target URL and the URLs in the Location
+// and Content-Location response headers
+func (handler *Handler) serveUnsafe(w http.ResponseWriter, r *http.Request) (int, error) {
+	rec := httpserver.NewResponseRecorder(w)
+	if original, ok := w.(*httpserver.ResponseRecorder); ok {
+		rec.Replacer = original.Replacer
+	}
+
+	code, err := handler.Next.ServeHTTP(rec, r)
+
+	// An error code returned means nothing was written, otherwise
+	// the recorded one is used because it can be 0 after writing
+	if err == nil && code < 400 && rec.Status() < 400 {
+		handler.invalidate(r, rec.Header())
+	}
+
+	return code, err
+}
+
+// invalidate hard purges the entries of the request URL and
+// the URLs in the location headers of its response
+func (handler *Handler) invalidate(r *http.Request, headers http.Header) {
+	requests := []*http.Request{r}
+
+	for _, name := range []string{"Location", "Content-Location"} {
+		target := sameHostURL(r, headers.Get(name))
+		if target == nil {
+			continue
+		}
+
+		// The keys are built with the original URL saved in the context
+		req := r.WithContext(context.WithValue(r.Context(), httpserver.OriginalURLCtxKey, *target))
+		req.URL = target
+		requests = append(requests, req)
+	}
+
+	for _, req := range requests {
+		for _, key := range handler.requestKeys(req) {
+			handler.Cache.Purge(key, HardPurge)
+		}
+	}
+}
+
+// sameHostURL resolves a location against the request URL. It returns nil
+// if the location is empty, invalid or points to another host, since
+// otherwise a server could invalidate the entries of other hosts
+func sameHostURL(r *http.Request, location string) *url.URL {
+	if location == "" {
+		return nil
+	}
+
+	target, err := r.URL.Parse(location)
+	if err != nil {
+		return nil
+	}
+
+	if target.Host != "" && !strings.EqualFold(target.Host, r.Host) {
+		return nil
+	}
+
+	return target
+}
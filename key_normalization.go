@@ -0,0 +1,127 @@
+package cache
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+// KeyNormalization rewrites the URL of a request before its cache key
+// is built, so equivalent URLs share the same entry
+type KeyNormalization struct {
+	// SortQuery sorts the query parameters by name
+	SortQuery bool
+	// IgnoreParams are names or globs of query parameters removed from the key
+	IgnoreParams []string
+	// KeepParams are names or globs of the only query parameters kept in the key
+	KeepParams []string
+	// LowercaseHost lowercases the host
+	LowercaseHost bool
+	// MergeSlashes replaces repeated slashes in the path by a single one
+	MergeSlashes bool
+}
+
+var repeatedSlashes = regexp.MustCompile("/{2,}")
+
+// normalize returns a copy of the request with its URL normalized
+// The original URL saved in the context is normalized too because
+// placeholders like {path} and {query} are taken from it
+func (n *KeyNormalization) normalize(r *http.Request) *http.Request {
+	if n == nil {
+		return r
+	}
+
+	ctx := r.Context()
+	if original, ok := ctx.Value(httpserver.OriginalURLCtxKey).(url.URL); ok {
+		ctx = context.WithValue(ctx, httpserver.OriginalURLCtxKey, n.normalizeURL(original))
+	}
+
+	req := r.WithContext(ctx)
+	normalized := n.normalizeURL(*r.URL)
+	req.URL = &normalized
+
+	if n.LowercaseHost {
+		req.Host = strings.ToLower(req.Host)
+	}
+
+	return req
+}
+
+func (n *KeyNormalization) normalizeURL(u url.URL) url.URL {
+	if n.LowercaseHost {
+		u.Host = strings.ToLower(u.Host)
+	}
+
+	if n.MergeSlashes {
+		u.Path = repeatedSlashes.ReplaceAllString(u.Path, "/")
+		if u.RawPath != "" {
+			u.RawPath = repeatedSlashes.ReplaceAllString(u.RawPath, "/")
+		}
+	}
+
+	u.RawQuery = n.normalizeQuery(u.RawQuery)
+	return u
+}
+
+// normalizeQuery filters and sorts the query parameters. It works on the
+// raw query so the parameters that are kept are not encoded again
+func (n *KeyNormalization) normalizeQuery(rawQuery string) string {
+	if rawQuery == "" || (!n.SortQuery && len(n.IgnoreParams) == 0 && len(n.KeepParams) == 0) {
+		return rawQuery
+	}
+
+	type param struct {
+		name string
+		raw  string
+	}
+
+	params := []param{}
+	for _, raw := range strings.Split(rawQuery, "&") {
+		if raw == "" {
+			continue
+		}
+
+		name := strings.SplitN(raw, "=", 2)[0]
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+
+		if matchesAnyParam(name, n.IgnoreParams) {
+			continue
+		}
+		if len(n.KeepParams) > 0 && !matchesAnyParam(name, n.KeepParams) {
+			continue
+		}
+
+		params = append(params, param{name, raw})
+	}
+
+	// Parameters with the same name keep their order because it can be meaningful
+	if n.SortQuery {
+		sort.SliceStable(params, func(i, j int) bool {
+			return params[i].name < params[j].name
+		})
+	}
+
+	kept := make([]string, len(params))
+	for i, p := range params {
+		kept[i] = p.raw
+	}
+	return strings.Join(kept, "&")
+}
+
+// matchesAnyParam returns if the name is equal or matches the glob of any pattern
+func matchesAnyParam(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matched, err := path.Match(pattern, name); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package cache
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyNormalization(t *testing.T) {
+	key := func(normalization *KeyNormalization, URL string) string {
+		r, err := http.NewRequest("GET", URL, nil)
+		require.NoError(t, err)
+		r = r.WithContext(context.WithValue(r.Context(), httpserver.OriginalURLCtxKey, *r.URL))
+		return getKey(defaultCacheKeyTemplate, normalization, r)
+	}
+
+	t.Run("it should not change the key without normalization", func(t *testing.T) {
+		require.Equal(t, "GET Example.com//a?b=2&a=1", key(nil, "http://Example.com//a?b=2&a=1"))
+	})
+
+	t.Run("it should sort the query keeping the order of repeated params", func(t *testing.T) {
+		n := &KeyNormalization{SortQuery: true}
+		require.Equal(t, "GET example.com/a?a=1&b=2", key(n, "http://example.com/a?b=2&a=1"))
+		require.Equal(t, "GET example.com/a?a=2&a=1&b=3", key(n, "http://example.com/a?b=3&a=2&a=1"))
+	})
+
+	t.Run("it should remove ignored params", func(t *testing.T) {
+		n := &KeyNormalization{IgnoreParams: []string{"utm_*", "fbclid"}}
+		require.Equal(t, "GET example.com/a?id=1", key(n, "http://example.com/a?utm_source=x&id=1&fbclid=abc&utm_medium=y"))
+		require.Equal(t, "GET example.com/a?", key(n, "http://example.com/a?utm_source=x"))
+	})
+
+	t.Run("it should only keep allowed params", func(t *testing.T) {
+		n := &KeyNormalization{KeepParams: []string{"id", "page"}, IgnoreParams: []string{"page"}}
+		require.Equal(t, "GET example.com/a?id=1", key(n, "http://example.com/a?gclid=x&id=1&page=2"))
+	})
+
+	t.Run("it should keep the params escaped", func(t *testing.T) {
+		n := &KeyNormalization{SortQuery: true}
+		require.Equal(t, "GET example.com/a?a=%26&b=%20", key(n, "http://example.com/a?b=%20&a=%26"))
+	})
+
+	t.Run("it should lowercase the host and merge slashes", func(t *testing.T) {
+		n := &KeyNormalization{LowercaseHost: true, MergeSlashes: true}
+		require.Equal(t, "GET example.com/a/b/?x=1", key(n, "http://Example.COM//a///b/?x=1"))
+	})
+}
@@ -0,0 +1,167 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lruList keeps the stored entries ordered by their last use
+// and the disk space and memory used by their bodies
+type lruList struct {
+	lock       *sync.Mutex
+	entries    *list.List
+	elements   map[*HTTPCacheEntry]*list.Element
+	diskSize   int64
+	memorySize int64
+}
+
+type lruItem struct {
+	entry    *HTTPCacheEntry
+	size     int64
+	inMemory bool
+}
+
+// usage returns the counter of the space used by the item body
+func (l *lruList) usage(item *lruItem) *int64 {
+	if item.inMemory {
+		return &l.memorySize
+	}
+	return &l.diskSize
+}
+
+func newLRUList() *lruList {
+	return &lruList{
+		lock:     new(sync.Mutex),
+		entries:  list.New(),
+		elements: make(map[*HTTPCacheEntry]*list.Element),
+	}
+}
+
+// add saves the entry as the most recently used one
+func (l *lruList) add(entry *HTTPCacheEntry) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if _, exists := l.elements[entry]; exists {
+		return
+	}
+	l.elements[entry] = l.entries.PushFront(&lruItem{entry: entry})
+}
+
+// touch marks the entry as the most recently used one
+func (l *lruList) touch(entry *HTTPCacheEntry) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if element, exists := l.elements[entry]; exists {
+		l.entries.MoveToFront(element)
+	}
+}
+
+func (l *lruList) remove(entry *HTTPCacheEntry) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	element, exists := l.elements[entry]
+	if !exists {
+		return
+	}
+
+	item := element.Value.(*lruItem)
+	*l.usage(item) -= item.size
+	l.entries.Remove(element)
+	delete(l.elements, entry)
+}
+
+// replace puts newEntry in the place of oldEntry keeping its
+// position and size. It is used when both share the same body
+func (l *lruList) replace(oldEntry *HTTPCacheEntry, newEntry *HTTPCacheEntry) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	element, exists := l.elements[oldEntry]
+	if !exists {
+		return
+	}
+
+	element.Value.(*lruItem).entry = newEntry
+	delete(l.elements, oldEntry)
+	l.elements[newEntry] = element
+}
+
+// setSize updates the space used by the entry body, on disk or
+// in memory, if the entry is still in the list
+func (l *lruList) setSize(entry *HTTPCacheEntry, size int64, inMemory bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	element, exists := l.elements[entry]
+	if !exists {
+		return
+	}
+
+	item := element.Value.(*lruItem)
+	*l.usage(item) -= item.size
+	item.size = size
+	item.inMemory = inMemory
+	*l.usage(item) += size
+}
+
+// overLimit returns the least recently used entries that have to be removed to have
+// at most maxEntries using at most maxDiskSize bytes of disk and maxMemorySize bytes
+// of memory. A limit of 0 means no limit. When only a size limit is exceeded just
+// the entries stored there are returned. Entries that are being read are never returned
+func (l *lruList) overLimit(maxEntries int, maxDiskSize int64, maxMemorySize int64) []*HTTPCacheEntry {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	victims := []*HTTPCacheEntry{}
+	count := l.entries.Len()
+	diskSize := l.diskSize
+	memorySize := l.memorySize
+
+	for element := l.entries.Back(); element != nil; element = element.Prev() {
+		tooMany := maxEntries > 0 && count > maxEntries
+		diskFull := maxDiskSize > 0 && diskSize > maxDiskSize
+		memoryFull := maxMemorySize > 0 && memorySize > maxMemorySize
+		if !tooMany && !diskFull && !memoryFull {
+			break
+		}
+
+		item := element.Value.(*lruItem)
+		if item.entry.hasActiveReaders() {
+			continue
+		}
+		if !tooMany && (item.inMemory && !memoryFull || !item.inMemory && !diskFull) {
+			continue
+		}
+
+		victims = append(victims, item.entry)
+		count--
+		if item.inMemory {
+			memorySize -= item.size
+		} else {
+			diskSize -= item.size
+		}
+	}
+
+	return victims
+}
+
+func (l *lruList) len() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.entries.Len()
+}
+
+func (l *lruList) size() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.diskSize
+}
+
+func (l *lruList) memory() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.memorySize
+}
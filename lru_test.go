@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/nicolasazrak/caddy-cache/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLRUList(t *testing.T) {
+	newEntry := func() *HTTPCacheEntry {
+		return &HTTPCacheEntry{Response: NewResponse()}
+	}
+
+	t.Run("it should return the least recently used entries over the limit", func(t *testing.T) {
+		l := newLRUList()
+		a, b, c := newEntry(), newEntry(), newEntry()
+		l.add(a)
+		l.add(b)
+		l.add(c)
+		l.touch(a)
+
+		require.Equal(t, []*HTTPCacheEntry{b}, l.overLimit(2, 0, 0))
+		require.Equal(t, []*HTTPCacheEntry{b, c}, l.overLimit(1, 0, 0))
+		require.Equal(t, []*HTTPCacheEntry{}, l.overLimit(0, 0, 0))
+	})
+
+	t.Run("it should return entries until the disk size is under the limit", func(t *testing.T) {
+		l := newLRUList()
+		a, b, c := newEntry(), newEntry(), newEntry()
+		l.add(a)
+		l.add(b)
+		l.add(c)
+		l.setSize(a, 10, false)
+		l.setSize(b, 20, false)
+		l.setSize(c, 30, false)
+
+		require.Equal(t, []*HTTPCacheEntry{a, b}, l.overLimit(0, 30, 0))
+
+		l.remove(b)
+		require.Equal(t, []*HTTPCacheEntry{a}, l.overLimit(0, 30, 0))
+		require.Equal(t, 2, l.len())
+	})
+
+	t.Run("it should only return entries kept in memory when the memory size is over the limit", func(t *testing.T) {
+		l := newLRUList()
+		a, b, c := newEntry(), newEntry(), newEntry()
+		l.add(a)
+		l.add(b)
+		l.add(c)
+		l.setSize(a, 10, false)
+		l.setSize(b, 20, true)
+		l.setSize(c, 30, true)
+
+		require.Equal(t, []*HTTPCacheEntry{b}, l.overLimit(0, 0, 30))
+		require.Equal(t, []*HTTPCacheEntry{}, l.overLimit(0, 10, 50))
+		require.Equal(t, int64(10), l.size())
+		require.Equal(t, int64(50), l.memory())
+	})
+
+	t.Run("it should keep the position of replaced entries", func(t *testing.T) {
+		l := newLRUList()
+		a, b, replacement := newEntry(), newEntry(), newEntry()
+		l.add(a)
+		l.add(b)
+		l.replace(a, replacement)
+
+		require.Equal(t, []*HTTPCacheEntry{replacement}, l.overLimit(1, 0, 0))
+	})
+
+	t.Run("it should not return entries that are being read", func(t *testing.T) {
+		body, err := storage.NewFileStorage("")
+		require.NoError(t, err)
+		defer body.Clean()
+
+		reader, err := body.GetReader()
+		require.NoError(t, err)
+
+		l := newLRUList()
+		read := &HTTPCacheEntry{isPublic: true, Response: NewResponse()}
+		read.Response.SetBody(body)
+		other := newEntry()
+		l.add(read)
+		l.add(other)
+
+		require.Equal(t, []*HTTPCacheEntry{other}, l.overLimit(1, 0, 0))
+
+		body.Close()
+		reader.Close()
+		require.Equal(t, []*HTTPCacheEntry{read}, l.overLimit(1, 0, 0))
+	})
+}
@@ -0,0 +1,262 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	servedFromCache    = "cache"
+	servedFromUpstream = "upstream"
+)
+
+var defaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics collects how the cache behaves and writes it in Prometheus text format
+type Metrics struct {
+	group    string
+	siteHost string
+
+	requests        *counterVec
+	servedBytes     *counterVec
+	collapsed       *counterVec
+	upstreamLatency *histogramVec
+	lockWait        *histogramVec
+}
+
+// NewMetrics creates empty metrics. If group is not empty every metric has it as
+// its group label. The host label is the siteHost, see hostLabel
+func NewMetrics(group string, siteHost string) *Metrics {
+	return &Metrics{
+		group:           group,
+		siteHost:        siteHost,
+		requests:        newCounterVec(),
+		servedBytes:     newCounterVec(),
+		collapsed:       newCounterVec(),
+		upstreamLatency: newHistogramVec(defaultLatencyBuckets),
+		lockWait:        newHistogramVec(defaultLatencyBuckets),
+	}
+}
+
+// labels formats the label pairs, adding the group if it is configured
+func (m *Metrics) labels(pairs ...string) string {
+	if m.group != "" {
+		pairs = append([]string{"group", m.group}, pairs...)
+	}
+
+	formatted := []string{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		formatted = append(formatted, pairs[i]+`="`+escapeLabelValue(pairs[i+1])+`"`)
+	}
+	return strings.Join(formatted, ",")
+}
+
+func (m *Metrics) observeRequest(r *http.Request, status string) {
+	m.requests.add(m.labels("host", m.hostLabel(r), "status", status), 1)
+}
+
+func (m *Metrics) observeServedBytes(r *http.Request, source string, bytes int64) {
+	m.servedBytes.add(m.labels("host", m.hostLabel(r), "source", source), float64(bytes))
+}
+
+func (m *Metrics) observeCollapsed(r *http.Request) {
+	m.collapsed.add(m.labels("host", m.hostLabel(r)), 1)
+}
+
+func (m *Metrics) observeUpstreamLatency(r *http.Request, duration time.Duration) {
+	m.upstreamLatency.observe(m.labels("host", m.hostLabel(r)), duration.Seconds())
+}
+
+func (m *Metrics) observeLockWait(r *http.Request, duration time.Duration) {
+	m.lockWait.observe(m.labels("host", m.hostLabel(r)), duration.Seconds())
+}
+
+// write writes every metric, including the ones taken from the cache, in Prometheus text format
+func (m *Metrics) write(w io.Writer, cache *HTTPCache) {
+	m.requests.write(w, "caddy_cache_requests_total", "Requests handled by the cache by status.")
+	m.servedBytes.write(w, "caddy_cache_served_bytes_total", "Body bytes served from the cache or from upstream.")
+	m.collapsed.write(w, "caddy_cache_collapsed_requests_total", "Requests served with a response fetched while they waited for the lock.")
+	m.upstreamLatency.write(w, "caddy_cache_upstream_duration_seconds", "Time until upstream sends the response headers.")
+	m.lockWait.write(w, "caddy_cache_lock_wait_seconds", "Time waiting for the lock of the requested key.")
+
+	writeSample(w, "caddy_cache_entries", "gauge", "Stored entries.", m.labels(), float64(cache.lru.len()))
+	writeSample(w, "caddy_cache_disk_bytes", "gauge", "Disk space used by the stored bodies.", m.labels(), float64(cache.lru.size()))
+	writeSample(w, "caddy_cache_memory_bytes", "gauge", "Memory used by the stored bodies.", m.labels(), float64(cache.lru.memory()))
+	writeSample(w, "caddy_cache_evictions_total", "counter", "Entries removed to keep the cache within its limits.", m.labels(), float64(atomic.LoadUint64(&cache.evictions)))
+}
+
+// serveMetrics responds with the metrics
+func (handler *Handler) serveMetrics(w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == "GET" {
+		handler.Metrics.write(w, handler.Cache)
+	}
+	return http.StatusOK, nil
+}
+
+// hostLabel returns the host label of a request. It is the host of the site and not
+// the Host header, otherwise any client could create an unlimited number of series.
+// Requests to hosts the site does not serve and to catch-all sites are labeled other
+func (m *Metrics) hostLabel(r *http.Request) string {
+	if m.siteHost != "" && matchGlob(strings.ToLower(m.siteHost), strings.ToLower(requestHost(r))) {
+		return m.siteHost
+	}
+	return "other"
+}
+
+// requestHost returns the host of the request without the port
+func requestHost(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		return host
+	}
+	return r.Host
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func writeSample(w io.Writer, name string, kind string, help string, labels string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	fmt.Fprintf(w, "%s{%s} %v\n", name, labels, value)
+}
+
+/////////////////////////////////////////
+
+// counterVec keeps a counter for each set of labels
+type counterVec struct {
+	lock   *sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec() *counterVec {
+	return &counterVec{
+		lock:   new(sync.Mutex),
+		values: make(map[string]float64),
+	}
+}
+
+func (c *counterVec) add(labels string, value float64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.values[labels] += value
+}
+
+func (c *counterVec) write(w io.Writer, name string, help string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	keys := []string{}
+	for labels := range c.values {
+		keys = append(keys, labels)
+	}
+	sort.Strings(keys)
+
+	for _, labels := range keys {
+		fmt.Fprintf(w, "%s{%s} %v\n", name, labels, c.values[labels])
+	}
+}
+
+// histogramVec keeps a histogram for each set of labels
+type histogramVec struct {
+	lock    *sync.Mutex
+	buckets []float64
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // observations in each bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(buckets []float64) *histogramVec {
+	return &histogramVec{
+		lock:    new(sync.Mutex),
+		buckets: buckets,
+		values:  make(map[string]*histogram),
+	}
+}
+
+func (h *histogramVec) observe(labels string, value float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	values, exists := h.values[labels]
+	if !exists {
+		values = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[labels] = values
+	}
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			values.counts[i]++
+			break
+		}
+	}
+	values.sum += value
+	values.count++
+}
+
+func (h *histogramVec) write(w io.Writer, name string, help string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	keys := []string{}
+	for labels := range h.values {
+		keys = append(keys, labels)
+	}
+	sort.Strings(keys)
+
+	for _, labels := range keys {
+		values := h.values[labels]
+		separator := ""
+		if labels != "" {
+			separator = ","
+		}
+
+		cumulative := uint64(0)
+		for i, bound := range h.buckets {
+			cumulative += values.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s%sle=\"%v\"} %d\n", name, labels, separator, bound, cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, separator, values.count)
+		fmt.Fprintf(w, "%s_sum{%s} %v\n", name, labels, values.sum)
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, values.count)
+	}
+}
+
+/////////////////////////////////////////
+
+// countingWriter counts the body bytes written to a ResponseWriter
+type countingWriter struct {
+	http.ResponseWriter
+	written int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(p)
+	c.written += int64(n)
+	return n, err
+}
+
+// Flush keeps streaming private responses as they are received
+func (c *countingWriter) Flush() {
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,195 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nicolasazrak/caddy-cache/storage"
+)
+
+var (
+	// persistingCaches has the cache that persists the entries of each path
+	persistingCaches = map[string]*HTTPCache{}
+	persistingLock   = new(sync.Mutex)
+)
+
+// claimPath makes the cache the one that persists the entries of path. On a reload
+// the new instance restores the entries before the old one is stopped, so the old
+// cache is closed first. Otherwise it could remove the files that were just restored
+func (cache *HTTPCache) claimPath(path string) {
+	if absolute, err := filepath.Abs(path); err == nil {
+		path = absolute
+	}
+
+	persistingLock.Lock()
+	previous := persistingCaches[path]
+	persistingCaches[path] = cache
+	persistingLock.Unlock()
+
+	if previous != nil && previous != cache {
+		previous.Close()
+	}
+}
+
+// releasePath forgets the cache once it is closed
+func releasePath(cache *HTTPCache) {
+	persistingLock.Lock()
+	defer persistingLock.Unlock()
+
+	for path, other := range persistingCaches {
+		if other == cache {
+			delete(persistingCaches, path)
+		}
+	}
+}
+
+// entryMetadata is saved next to a stored body to restore its entry after a restart
+type entryMetadata struct {
+	Key               string      `json:"key"`
+	Method            string      `json:"method"`
+	Host              string      `json:"host"`
+	URL               string      `json:"url"`
+	VaryHeaders       http.Header `json:"vary_headers"`
+	Code              int         `json:"code"`
+	Header            http.Header `json:"header"`
+	Expiration        time.Time   `json:"expiration"`
+	StaleUntil        time.Time   `json:"stale_until"`
+	StaleIfErrorUntil time.Time   `json:"stale_if_error_until"`
+	StoredUntil       time.Time   `json:"stored_until"`
+	StoredAt          time.Time   `json:"stored_at"`
+	Tags              []string    `json:"tags"`
+	BodySize          int64       `json:"body_size"`
+}
+
+// persist saves the metadata of a public entry stored on disk
+// It must be called once the whole body is stored
+func (e *HTTPCacheEntry) persist() error {
+	file, ok := e.Response.body.(*storage.FileStorage)
+	if !ok || !e.isPublic {
+		return nil
+	}
+
+	data, err := json.Marshal(entryMetadata{
+		Key:               e.key,
+		Method:            e.Request.Method,
+		Host:              e.Request.Host,
+		URL:               e.Request.URL.String(),
+		VaryHeaders:       e.varyHeaders(), // The only ones needed to restore the request
+		Code:              e.Response.Code,
+		Header:            e.Response.snapHeader,
+		Expiration:        e.expiration,
+		StaleUntil:        e.staleUntil,
+		StaleIfErrorUntil: e.staleIfErrorUntil,
+		StoredUntil:       e.storedUntil,
+		StoredAt:          e.storedAt,
+		Tags:              e.tags,
+		BodySize:          e.Response.storedSize(),
+	})
+	if err != nil {
+		return err
+	}
+
+	return file.SaveMetadata(data)
+}
+
+// restoreEntry creates an entry from a file stored by a previous process
+func restoreEntry(file storage.StoredFile) (*HTTPCacheEntry, error) {
+	metadata := entryMetadata{}
+	if err := json.Unmarshal(file.Metadata, &metadata); err != nil {
+		return nil, err
+	}
+
+	if metadata.Key == "" || metadata.BodySize != file.Size {
+		return nil, errors.New("Corrupt cache entry " + file.Name)
+	}
+
+	request, err := http.NewRequest(metadata.Method, metadata.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Host = metadata.Host
+	request.Header = metadata.VaryHeaders
+	if request.Header == nil {
+		request.Header = http.Header{}
+	}
+
+	body, err := storage.OpenFileStorage(file.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	response := NewResponse()
+	response.Code = metadata.Code
+	response.wroteHeader = true
+	response.firstByteSent = true
+	response.body = body
+	response.bodySize = metadata.BodySize
+	response.complete = 1
+	response.snapHeader = metadata.Header
+	if response.snapHeader == nil {
+		response.snapHeader = http.Header{}
+	}
+	copyHeaders(response.snapHeader, response.HeaderMap)
+	response.headersLock.Unlock()
+	response.bodyLock.Unlock()
+	response.closedLock.Unlock()
+
+	// Entries persisted before the time was saved are taken as stored now
+	storedAt := metadata.StoredAt
+	if storedAt.IsZero() {
+		storedAt = now()
+	}
+
+	return &HTTPCacheEntry{
+		key:               metadata.Key,
+		isPublic:          true,
+		expiration:        metadata.Expiration,
+		staleUntil:        metadata.StaleUntil,
+		staleIfErrorUntil: metadata.StaleIfErrorUntil,
+		storedUntil:       metadata.StoredUntil,
+		storedAt:          storedAt,
+		tags:              metadata.Tags,
+		Request:           request,
+		Response:          response,
+	}, nil
+}
+
+// Restore loads the entries persisted in path by a previous process and
+// keeps persisting the new ones. Expired or corrupt entries are removed and
+// files without metadata are left untouched as they may still be written.
+// The cache that persisted the entries of path before is closed.
+// It returns how many entries were restored
+func (cache *HTTPCache) Restore(path string) (int, error) {
+	cache.claimPath(path)
+
+	files, err := storage.ListFiles(path)
+	if err != nil {
+		return 0, err
+	}
+
+	cache.persistent = true
+
+	restored := 0
+	for _, file := range files {
+		if file.Metadata == nil {
+			continue
+		}
+
+		entry, err := restoreEntry(file)
+		if err != nil || !entry.Stored() {
+			storage.RemoveFile(file.Name)
+			continue
+		}
+
+		cache.put(entry)
+		cache.lru.setSize(entry, entry.Response.storedSize(), false)
+		restored++
+	}
+
+	cache.evict()
+	return restored, nil
+}
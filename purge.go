@@ -0,0 +1,186 @@
+package cache
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	purgeRegexHeader  = "X-Purge-Regex"
+	purgeDryRunHeader = "X-Purge-Dry-Run"
+	purgeSoftHeader   = "X-Purge-Soft"
+)
+
+// isPurge returns if the request asks to remove entries from the cache
+func (handler *Handler) isPurge(r *http.Request) bool {
+	return handler.Config.PurgeMethod != "" && r.Method == handler.Config.PurgeMethod
+}
+
+// canPurge returns if the client is allowed to purge
+func (handler *Handler) canPurge(r *http.Request) bool {
+	config := handler.Config
+	return isAuthorized(r, config.PurgeAllow, config.PurgeSecretHeader, config.PurgeSecret)
+}
+
+// isAuthorized returns if the client address is in the allowed
+// networks or it sent the shared secret in the secret header
+func isAuthorized(r *http.Request, allow []*net.IPNet, secretHeader string, secret string) bool {
+	if secretHeader != "" {
+		sent := r.Header.Get(secretHeader)
+		if subtle.ConstantTimeCompare([]byte(sent), []byte(secret)) == 1 {
+			return true
+		}
+	}
+
+	return ipInNetworks(clientIP(r), allow)
+}
+
+// requestKeys returns the keys that GET and HEAD requests
+// to the URL of the request would have
+func (handler *Handler) requestKeys(r *http.Request) []string {
+	keys := []string{}
+
+	for _, method := range []string{"GET", "HEAD"} {
+		req := r.WithContext(r.Context())
+		req.Method = method
+		key := getKey(handler.Config.CacheKeyTemplate, handler.Config.KeyNormalization, req)
+
+		if len(keys) == 0 || keys[0] != key {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// purgeTags returns the tags sent in the purge request
+func (handler *Handler) purgeTags(r *http.Request) []string {
+	if handler.Config.TagHeader == "" {
+		return nil
+	}
+	return parseTags(r.Header.Get(handler.Config.TagHeader))
+}
+
+// purgeMode reads from the purge request headers if the
+// entries have to be marked as stale or only reported
+func purgeMode(r *http.Request) PurgeMode {
+	if isTrue(r.Header.Get(purgeDryRunHeader)) {
+		return DryRunPurge
+	}
+	if isTrue(r.Header.Get(purgeSoftHeader)) {
+		return SoftPurge
+	}
+	return HardPurge
+}
+
+func isTrue(value string) bool {
+	value = strings.ToLower(value)
+	return value == "true" || value == "1" || value == "yes"
+}
+
+// purge purges every variant stored for the requested URL. Instead of the exact URL
+// the request can select the entries by tags using the configured tag header,
+// by path prefix ending the path with * or by a regular expression matched against the keys
+func (handler *Handler) purge(w http.ResponseWriter, r *http.Request) (int, error) {
+	if !handler.canPurge(r) {
+		return http.StatusForbidden, nil
+	}
+
+	mode := purgeMode(r)
+	purged := []string{}
+
+	if tags := handler.purgeTags(r); len(tags) > 0 {
+		purged = handler.Cache.PurgeTags(tags, mode)
+	} else if pattern := r.Header.Get(purgeRegexHeader); pattern != "" {
+		keyRegex, err := regexp.Compile(pattern)
+		if err != nil {
+			return http.StatusBadRequest, nil
+		}
+		purged = handler.Cache.PurgeWhere(func(entry *HTTPCacheEntry) bool {
+			return keyRegex.MatchString(entry.Key())
+		}, mode)
+	} else if strings.HasSuffix(r.URL.Path, "*") {
+		prefix := strings.TrimSuffix(r.URL.Path, "*")
+		purged = handler.Cache.PurgeWhere(func(entry *HTTPCacheEntry) bool {
+			return entry.Request.Host == r.Host && strings.HasPrefix(entry.Request.URL.Path, prefix)
+		}, mode)
+	} else {
+		for _, key := range handler.requestKeys(r) {
+			purged = append(purged, handler.Cache.Purge(key, mode)...)
+		}
+	}
+
+	if mode == DryRunPurge {
+		return writePurgeReport(w, purged)
+	}
+
+	if len(purged) == 0 {
+		return http.StatusNotFound, nil
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return http.StatusOK, nil
+}
+
+// writePurgeReport responds with the number of entries that matched and their keys
+func writePurgeReport(w http.ResponseWriter, purged []string) (int, error) {
+	keys := []string{}
+	seen := map[string]bool{}
+	for _, key := range purged {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err := json.NewEncoder(w).Encode(struct {
+		Count int      `json:"count"`
+		Keys  []string `json:"keys"`
+	}{len(purged), keys})
+
+	return http.StatusOK, err
+}
+
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+func ipInNetworks(ip net.IP, networks []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseNetwork parses an IP range in CIDR notation or a single IP
+func parseNetwork(value string) (*net.IPNet, error) {
+	if !strings.Contains(value, "/") {
+		if ip := net.ParseIP(value); ip != nil && ip.To4() != nil {
+			value += "/32"
+		} else {
+			value += "/128"
+		}
+	}
+
+	_, network, err := net.ParseCIDR(value)
+	return network, err
+}
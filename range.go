@@ -0,0 +1,222 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+var (
+	errInvalidRange       = errors.New("invalid range")
+	errUnsatisfiableRange = errors.New("unsatisfiable range")
+)
+
+// httpRange is a part of the body requested with a Range header
+type httpRange struct {
+	start  int64
+	length int64
+}
+
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange parses a Range header as described in RFC 7233 for a body of the given size.
+// Ranges that start after the end of the body are ignored and if none of them
+// overlaps the body errUnsatisfiableRange is returned.
+func parseRange(header string, size int64) ([]httpRange, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return nil, errInvalidRange
+	}
+
+	ranges := []httpRange{}
+	noOverlap := false
+
+	for _, spec := range strings.Split(header[len(prefix):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		i := strings.Index(spec, "-")
+		if i < 0 {
+			return nil, errInvalidRange
+		}
+
+		start, end := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+		var r httpRange
+
+		if start == "" {
+			// Suffix range, the last N bytes of the body
+			n, err := strconv.ParseInt(end, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errInvalidRange
+			}
+			if n > size {
+				n = size
+			}
+			if n == 0 {
+				noOverlap = true
+				continue
+			}
+			r.start = size - n
+			r.length = n
+		} else {
+			i, err := strconv.ParseInt(start, 10, 64)
+			if err != nil || i < 0 {
+				return nil, errInvalidRange
+			}
+			if i >= size {
+				noOverlap = true
+				continue
+			}
+			r.start = i
+
+			if end == "" {
+				r.length = size - r.start
+			} else {
+				j, err := strconv.ParseInt(end, 10, 64)
+				if err != nil || r.start > j {
+					return nil, errInvalidRange
+				}
+				if j >= size {
+					j = size - 1
+				}
+				r.length = j - r.start + 1
+			}
+		}
+
+		ranges = append(ranges, r)
+	}
+
+	if len(ranges) == 0 {
+		if noOverlap {
+			return nil, errUnsatisfiableRange
+		}
+		return nil, errInvalidRange
+	}
+
+	return ranges, nil
+}
+
+func sumRangesSize(ranges []httpRange) (size int64) {
+	for _, r := range ranges {
+		size += r.length
+	}
+	return
+}
+
+// contentLength returns the size of the stored body. If upstream did not
+// send a valid Content-Length it waits until the whole body is stored
+func (e *HTTPCacheEntry) contentLength() int64 {
+	if contentLength := e.Response.snapHeader.Get("Content-Length"); contentLength != "" {
+		size, err := strconv.ParseInt(contentLength, 10, 64)
+		if err == nil {
+			return size
+		}
+	}
+
+	e.Response.WaitClose()
+	return e.Response.storedSize()
+}
+
+// requestedRanges returns the parts of the body the client asked for and the size of the body.
+// It returns false if the whole body has to be sent because there is no valid Range header,
+// the If-Range header does not match or the body can not be read from the storage.
+// An empty list of ranges means that none of them can be satisfied.
+func (e *HTTPCacheEntry) requestedRanges(r *http.Request) ([]httpRange, int64, bool) {
+	header := r.Header.Get("Range")
+	if header == "" || r.Method != "GET" || !e.isPublic || e.Response.Code != http.StatusOK {
+		return nil, 0, false
+	}
+
+	if !ifRangeMatches(r, e.Response.snapHeader) {
+		return nil, 0, false
+	}
+
+	size := e.contentLength()
+	ranges, err := parseRange(header, size)
+	if err == errUnsatisfiableRange {
+		return []httpRange{}, size, true
+	}
+
+	// Overlapping ranges bigger than the whole body are ignored
+	// instead of being used to amplify the response
+	if err != nil || sumRangesSize(ranges) > size {
+		return nil, 0, false
+	}
+
+	return ranges, size, true
+}
+
+// writeRangesTo sends the requested ranges of the body. A single range is sent as
+// it is and many ranges are sent as a multipart/byteranges body
+func (e *HTTPCacheEntry) writeRangesTo(w http.ResponseWriter, ranges []httpRange, size int64) (int, error) {
+	if len(ranges) == 0 {
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return http.StatusRequestedRangeNotSatisfiable, nil
+	}
+
+	if len(ranges) == 1 {
+		w.Header().Set("Content-Range", ranges[0].contentRange(size))
+		w.Header().Set("Content-Length", strconv.FormatInt(ranges[0].length, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		return http.StatusPartialContent, e.writeRangeTo(w, ranges[0])
+	}
+
+	contentType := w.Header().Get("Content-Type")
+	parts := multipart.NewWriter(w)
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "multipart/byteranges; boundary="+parts.Boundary())
+	w.WriteHeader(http.StatusPartialContent)
+
+	for _, r := range ranges {
+		partHeader := textproto.MIMEHeader{}
+		partHeader.Set("Content-Range", r.contentRange(size))
+		if contentType != "" {
+			partHeader.Set("Content-Type", contentType)
+		}
+
+		part, err := parts.CreatePart(partHeader)
+		if err != nil {
+			return http.StatusPartialContent, err
+		}
+
+		if err := e.writeRangeTo(part, r); err != nil {
+			return http.StatusPartialContent, err
+		}
+	}
+
+	return http.StatusPartialContent, parts.Close()
+}
+
+// writeRangeTo copies a single range of the stored body. If the body is still
+// being downloaded it blocks until the requested bytes are written
+func (e *HTTPCacheEntry) writeRangeTo(w io.Writer, r httpRange) error {
+	reader, err := e.Response.body.GetReader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	if seeker, ok := reader.(io.Seeker); ok {
+		_, err = seeker.Seek(r.start, io.SeekStart)
+	} else {
+		_, err = io.CopyN(ioutil.Discard, reader, r.start)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(w, reader, r.length)
+	return err
+}
@@ -0,0 +1,131 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pquerna/cachecontrol/cacheobject"
+)
+
+// requestDirectives are the Cache-Control directives sent by the client
+// Durations are -1 when the directive was not sent
+type requestDirectives struct {
+	noCache      bool
+	onlyIfCached bool
+	maxAge       time.Duration
+	minFresh     time.Duration
+	maxStale     time.Duration
+	maxStaleAny  bool // max-stale without a value accepts any staleness
+}
+
+// parseRequestDirectives parses the request Cache-Control header.
+// Unknown directives and invalid values are ignored
+func parseRequestDirectives(headers http.Header) *requestDirectives {
+	directives := &requestDirectives{maxAge: -1, minFresh: -1, maxStale: -1}
+
+	cacheControl := headers.Get("Cache-Control")
+	if cacheControl == "" {
+		// HTTP/1.0 clients use Pragma instead of Cache-Control
+		directives.noCache = strings.EqualFold(strings.TrimSpace(headers.Get("Pragma")), "no-cache")
+		return directives
+	}
+
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value := strings.TrimSpace(directive), ""
+		if i := strings.Index(name, "="); i >= 0 {
+			name, value = strings.TrimSpace(name[:i]), strings.Trim(strings.TrimSpace(name[i+1:]), `"`)
+		}
+
+		switch strings.ToLower(name) {
+		case "no-cache":
+			directives.noCache = true
+		case "only-if-cached":
+			directives.onlyIfCached = true
+		case "max-age":
+			directives.maxAge = parseDeltaSeconds(value)
+		case "min-fresh":
+			directives.minFresh = parseDeltaSeconds(value)
+		case "max-stale":
+			if value == "" {
+				directives.maxStaleAny = true
+			} else {
+				directives.maxStale = parseDeltaSeconds(value)
+			}
+		}
+	}
+
+	return directives
+}
+
+func parseDeltaSeconds(value string) time.Duration {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return -1
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// acceptsFresh returns if the client accepts a fresh entry
+// A nil requestDirectives accepts every entry
+func (d *requestDirectives) acceptsFresh(entry *HTTPCacheEntry) bool {
+	if d == nil {
+		return true
+	}
+
+	if d.noCache {
+		return false
+	}
+
+	if d.maxAge >= 0 && entry.age() > d.maxAge {
+		return false
+	}
+
+	return d.minFresh < 0 || entry.expiration.Sub(now()) >= d.minFresh
+}
+
+// acceptsStale returns if the client accepts the entry without
+// validating it although it is stale because it sent max-stale
+func (d *requestDirectives) acceptsStale(entry *HTTPCacheEntry) bool {
+	if d == nil || !entry.isPublic || entry.Fresh() || d.noCache || (!d.maxStaleAny && d.maxStale < 0) {
+		return false
+	}
+
+	if d.maxAge >= 0 && entry.age() > d.maxAge {
+		return false
+	}
+
+	// The origin server does not allow serving it stale
+	if directives, err := cacheobject.ParseResponseCacheControl(entry.Response.snapHeader.Get("Cache-Control")); err != nil || directives.MustRevalidate || directives.ProxyRevalidate {
+		return false
+	}
+
+	return d.maxStaleAny || now().Sub(entry.expiration) <= d.maxStale
+}
+
+// allowsStaleWhileRevalidate returns if a stale entry can be served while
+// it is refreshed. Clients asking for a fresh response do not allow it
+func (d *requestDirectives) allowsStaleWhileRevalidate() bool {
+	return d == nil || (!d.noCache && d.maxAge < 0 && d.minFresh < 0)
+}
+
+// onlyCached returns if the client does not want the request to reach upstream
+func (d *requestDirectives) onlyCached() bool {
+	return d != nil && d.onlyIfCached
+}
+
+// requestDirectives returns the Cache-Control directives of the request
+// or nil if they are ignored because the client is not trusted
+func (handler *Handler) requestDirectives(r *http.Request) *requestDirectives {
+	config := handler.Config
+	if config.IgnoreRequestCacheControl {
+		return nil
+	}
+
+	if len(config.RequestCacheControlAllow) > 0 && !ipInNetworks(clientIP(r), config.RequestCacheControlAllow) {
+		return nil
+	}
+
+	return parseRequestDirectives(r.Header)
+}
@@ -0,0 +1,27 @@
+package cache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRequestDirectives(t *testing.T) {
+	tests := []struct {
+		headers http.Header
+		expect  requestDirectives
+	}{
+		{http.Header{}, requestDirectives{maxAge: -1, minFresh: -1, maxStale: -1}},
+		{makeHeader("Pragma", "no-cache"), requestDirectives{noCache: true, maxAge: -1, minFresh: -1, maxStale: -1}},
+		{makeHeader("Cache-Control", "No-Cache, only-if-cached"), requestDirectives{noCache: true, onlyIfCached: true, maxAge: -1, minFresh: -1, maxStale: -1}},
+		{makeHeader("Cache-Control", `max-age=5, min-fresh="10"`), requestDirectives{maxAge: 5 * time.Second, minFresh: 10 * time.Second, maxStale: -1}},
+		{makeHeader("Cache-Control", "max-stale"), requestDirectives{maxAge: -1, minFresh: -1, maxStale: -1, maxStaleAny: true}},
+		{makeHeader("Cache-Control", "max-stale=30, max-age=abc"), requestDirectives{maxAge: -1, minFresh: -1, maxStale: 30 * time.Second}},
+	}
+
+	for _, test := range tests {
+		require.Equal(t, test.expect, *parseRequestDirectives(test.headers), test.headers)
+	}
+}
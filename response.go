@@ -4,16 +4,23 @@ import (
 	"errors"
 	"net/http"
 	"sync"
+	"sync/atomic"
 
 	"github.com/nicolasazrak/caddy-cache/storage"
 )
 
 type Response struct {
+	bodySize int64  // bytes written to the body, first to be aligned for atomic operations
+	hits     uint64 // times it was served from the cache, used atomically
+	complete int32  // set once there won't be more writes, used atomically
+
 	Code       int         // the HTTP response code from WriteHeader
 	HeaderMap  http.Header // the HTTP response headers
 	body       storage.ResponseStorage
 	snapHeader http.Header // copy of HTTP headeres at writeHeader time
 
+	revalidatedFrom *Response // stored response whose body is reused
+
 	wroteHeader   bool
 	firstByteSent bool
 
@@ -94,7 +101,9 @@ func (rw *Response) Write(buf []byte) (int, error) {
 	}
 
 	if rw.body != nil {
-		return rw.body.Write(buf)
+		n, err := rw.body.Write(buf)
+		atomic.AddInt64(&rw.bodySize, int64(n))
+		return n, err
 	}
 
 	return 0, errors.New("No storage")
@@ -152,6 +161,7 @@ func (rw *Response) Flush() {
 // Otherwise body won't be closed blocking the response
 func (rw *Response) Close() error {
 	defer rw.closedLock.Unlock()
+	atomic.StoreInt32(&rw.complete, 1)
 
 	if rw.body != nil {
 		return rw.body.Close()
@@ -159,6 +169,42 @@ func (rw *Response) Close() error {
 	return nil
 }
 
+// storedSize returns how many bytes were written to the body
+func (rw *Response) storedSize() int64 {
+	return atomic.LoadInt64(&rw.bodySize)
+}
+
+// bodyComplete returns if the whole body was written
+func (rw *Response) bodyComplete() bool {
+	return atomic.LoadInt32(&rw.complete) == 1
+}
+
+// servedCount returns how many times it was served from the cache
+func (rw *Response) servedCount() uint64 {
+	return atomic.LoadUint64(&rw.hits)
+}
+
+// storedOnDisk returns if the body is saved in a file
+func (rw *Response) storedOnDisk() bool {
+	_, ok := rw.body.(*storage.FileStorage)
+	return ok
+}
+
+// storedInMemory returns if the body is kept in memory
+func (rw *Response) storedInMemory() bool {
+	_, ok := rw.body.(*storage.MemoryStorage)
+	return ok
+}
+
+// hasReaders returns if there is someone reading the stored body
+// It must only be called once the body is set
+func (rw *Response) hasReaders() bool {
+	if body, ok := rw.body.(interface{ HasReaders() bool }); ok {
+		return body.HasReaders()
+	}
+	return false
+}
+
 // Clean the body if it is set
 func (rw *Response) Clean() error {
 	rw.bodyLock.RLock()
@@ -170,3 +216,33 @@ func (rw *Response) Clean() error {
 
 	return rw.body.Clean()
 }
+
+// revalidated returns an already closed Response that reuses the stored body
+// and has its headers updated with the ones sent in a 304 Not Modified
+func (rw *Response) revalidated(notModified *Response) *Response {
+	r := NewResponse()
+	r.Code = rw.Code
+	r.wroteHeader = true
+	r.firstByteSent = true
+	r.body = rw.body
+	r.bodySize = rw.storedSize()
+	r.hits = rw.servedCount()
+	r.complete = atomic.LoadInt32(&rw.complete)
+	r.revalidatedFrom = rw
+
+	r.snapHeader = http.Header{}
+	copyHeaders(rw.snapHeader, r.snapHeader)
+	for k, values := range notModified.snapHeader {
+		// A 304 has no body so its length must not replace the stored one
+		if k == "Content-Length" {
+			continue
+		}
+		r.snapHeader[k] = values
+	}
+	copyHeaders(r.snapHeader, r.HeaderMap)
+
+	r.headersLock.Unlock()
+	r.bodyLock.Unlock()
+	r.closedLock.Unlock()
+	return r
+}
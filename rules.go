@@ -2,6 +2,8 @@ package cache
 
 import (
 	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -19,11 +21,85 @@ type PathCacheRule struct {
 }
 
 // HeaderCacheRule matches if given Header matches any of the values
+// A * in a value matches any characters, like in image/*
 type HeaderCacheRule struct {
 	Header string
 	Value  []string
 }
 
+// StatusCacheRule matches if the response has any of the status codes
+type StatusCacheRule struct {
+	Codes []int
+}
+
+// PathRegexCacheRule matches if the request path matches the regular expression
+type PathRegexCacheRule struct {
+	Regex *regexp.Regexp
+}
+
+// HeaderRegexCacheRule matches if given Header matches the regular expression
+type HeaderRegexCacheRule struct {
+	Header string
+	Regex  *regexp.Regexp
+}
+
+// HeaderPresenceCacheRule matches if the response has the Header,
+// or if it does not have it when Present is false
+type HeaderPresenceCacheRule struct {
+	Header  string
+	Present bool
+}
+
+// ContentLengthCacheRule matches if the response Content-Length is between
+// Min and Max. A Max of 0 means there is no limit. Responses without
+// Content-Length never match because their size is unknown
+type ContentLengthCacheRule struct {
+	Min int64
+	Max int64
+}
+
+// AllCacheRule matches if all its rules match
+type AllCacheRule struct {
+	Rules []CacheRule
+}
+
+// AnyCacheRule matches if any of its rules matches
+type AnyCacheRule struct {
+	Rules []CacheRule
+}
+
+// NotCacheRule matches if none of its rules match
+type NotCacheRule struct {
+	Rules []CacheRule
+}
+
+// ActionCacheRule matches if all its rules match and decides how the
+// matched responses are cached
+type ActionCacheRule struct {
+	Rules []CacheRule
+
+	// TTL is used instead of the default max age, 0 means the default one
+	TTL time.Duration
+	// Override ignores the expiration sent by upstream and always uses the TTL
+	Override bool
+	// Directives of the response that do not prevent caching with Override
+	OverridePrivate bool
+	OverrideNoCache bool
+	OverrideNoStore bool
+	// Never makes the responses not cacheable even if they have an explicit expiration
+	Never bool
+}
+
+// StatusTTL sets for how long responses with a status between From and To
+// are cached when upstream did not send their freshness.
+// Responses with a Never status are not cached at all
+type StatusTTL struct {
+	From  int
+	To    int
+	TTL   time.Duration
+	Never bool
+}
+
 // Made for testing
 var now = time.Now
 
@@ -36,13 +112,105 @@ func (rule *PathCacheRule) matches(req *http.Request, statusCode int, respHeader
 func (rule *HeaderCacheRule) matches(req *http.Request, statusCode int, respHeaders http.Header) bool {
 	headerValue := respHeaders.Get(rule.Header)
 	for _, expectedValue := range rule.Value {
-		if expectedValue == headerValue {
+		if matchGlob(expectedValue, headerValue) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *StatusCacheRule) matches(req *http.Request, statusCode int, respHeaders http.Header) bool {
+	for _, code := range rule.Codes {
+		if code == statusCode {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *PathRegexCacheRule) matches(req *http.Request, statusCode int, respHeaders http.Header) bool {
+	return rule.Regex.MatchString(req.URL.Path)
+}
+
+func (rule *HeaderRegexCacheRule) matches(req *http.Request, statusCode int, respHeaders http.Header) bool {
+	for _, value := range respHeaders[http.CanonicalHeaderKey(rule.Header)] {
+		if rule.Regex.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *HeaderPresenceCacheRule) matches(req *http.Request, statusCode int, respHeaders http.Header) bool {
+	_, exists := respHeaders[http.CanonicalHeaderKey(rule.Header)]
+	return exists == rule.Present
+}
+
+func (rule *ContentLengthCacheRule) matches(req *http.Request, statusCode int, respHeaders http.Header) bool {
+	length, err := strconv.ParseInt(respHeaders.Get("Content-Length"), 10, 64)
+	if err != nil || length < rule.Min {
+		return false
+	}
+	return rule.Max == 0 || length <= rule.Max
+}
+
+func (rule *ActionCacheRule) matches(req *http.Request, statusCode int, respHeaders http.Header) bool {
+	return (&AllCacheRule{Rules: rule.Rules}).matches(req, statusCode, respHeaders)
+}
+
+// ttl returns for how long the responses that match are cached
+// when there is not an explicit expiration
+func (rule *ActionCacheRule) ttl(config *Config) time.Duration {
+	if rule.TTL > 0 {
+		return rule.TTL
+	}
+	return config.DefaultMaxAge
+}
+
+// ignoredReasons returns the reasons not to cache that the rule overrides
+func (rule *ActionCacheRule) ignoredReasons() []cacheobject.Reason {
+	reasons := []cacheobject.Reason{}
+	if rule.OverridePrivate {
+		reasons = append(reasons, cacheobject.ReasonResponsePrivate)
+	}
+	if rule.OverrideNoStore {
+		reasons = append(reasons, cacheobject.ReasonResponseNoStore)
+	}
+	return reasons
+}
+
+// preventedByNoCache returns if the response must not be cached by an
+// overriding rule because it has no-cache and the rule does not override it
+func (rule *ActionCacheRule) preventedByNoCache(respHeaders http.Header) bool {
+	if rule.OverrideNoCache {
+		return false
+	}
+	directives, err := cacheobject.ParseResponseCacheControl(respHeaders.Get("Cache-Control"))
+	return err != nil || directives.NoCachePresent
+}
+
+func (rule *AllCacheRule) matches(req *http.Request, statusCode int, respHeaders http.Header) bool {
+	for _, r := range rule.Rules {
+		if !r.matches(req, statusCode, respHeaders) {
+			return false
+		}
+	}
+	return true
+}
+
+func (rule *AnyCacheRule) matches(req *http.Request, statusCode int, respHeaders http.Header) bool {
+	for _, r := range rule.Rules {
+		if r.matches(req, statusCode, respHeaders) {
 			return true
 		}
 	}
 	return false
 }
 
+func (rule *NotCacheRule) matches(req *http.Request, statusCode int, respHeaders http.Header) bool {
+	return !(&AnyCacheRule{Rules: rule.Rules}).matches(req, statusCode, respHeaders)
+}
+
 func getCacheableStatus(req *http.Request, response *Response, config *Config) (bool, time.Time) {
 	// Partial responses are not supported yet
 	if response.Code == http.StatusPartialContent || response.snapHeader.Get("Content-Range") != "" {
@@ -53,6 +221,24 @@ func getCacheableStatus(req *http.Request, response *Response, config *Config) (
 		return false, now()
 	}
 
+	statusTTL, hasStatusTTL := getStatusTTL(response.Code, config.StatusTTLs)
+	if hasStatusTTL && statusTTL.Never {
+		return false, now().Add(config.LockTimeout)
+	}
+
+	// The first rule that matches decides how the response is cached
+	var matchedRule CacheRule
+	for _, rule := range config.CacheRules {
+		if rule.matches(req, response.Code, response.snapHeader) {
+			matchedRule = rule
+			break
+		}
+	}
+	action, hasAction := matchedRule.(*ActionCacheRule)
+	if hasAction && action.Never {
+		return false, now().Add(config.LockTimeout)
+	}
+
 	reasonsNotToCache, expiration, err := cacheobject.UsingRequestResponse(req, response.Code, response.snapHeader, false)
 
 	// err means there was an error parsing headers
@@ -61,6 +247,25 @@ func getCacheableStatus(req *http.Request, response *Response, config *Config) (
 		return false, time.Time{}
 	}
 
+	// A cached cookie would be sent to everyone that gets a hit
+	if response.snapHeader.Get("Set-Cookie") != "" && !config.AllowSetCookie && !isStrippedHeader("Set-Cookie", config) {
+		return false, now().Add(config.LockTimeout)
+	}
+
+	// A configured ttl makes cacheable the status codes that are not cacheable by default
+	if hasStatusTTL {
+		reasonsNotToCache = withoutReason(reasonsNotToCache, cacheobject.ReasonResponseUncachableByDefault)
+	}
+
+	if hasAction && action.Override {
+		if action.preventedByNoCache(response.snapHeader) {
+			return false, now().Add(config.LockTimeout)
+		}
+		for _, reason := range action.ignoredReasons() {
+			reasonsNotToCache = withoutReason(reasonsNotToCache, reason)
+		}
+	}
+
 	isPublic := len(reasonsNotToCache) == 0
 
 	if !isPublic {
@@ -72,17 +277,25 @@ func getCacheableStatus(req *http.Request, response *Response, config *Config) (
 		return false, now().Add(config.LockTimeout)
 	}
 
-	// Check if any rule matches
-	for _, rule := range config.CacheRules {
-		if rule.matches(req, response.Code, response.snapHeader) {
+	if hasAction && action.Override {
+		return true, now().Add(action.ttl(config))
+	}
 
-			// If any rule matches but the response has no explicit expiration
-			if expiration.Before(now()) {
-				// Use the default max age
-				expiration = now().Add(config.DefaultMaxAge)
+	if hasStatusTTL && expiration.Before(now()) {
+		return true, now().Add(statusTTL.TTL)
+	}
+
+	if matchedRule != nil {
+		// If a rule matches but the response has no explicit expiration
+		if expiration.Before(now()) {
+			// Use the rule ttl or the default max age
+			ttl := config.DefaultMaxAge
+			if hasAction {
+				ttl = action.ttl(config)
 			}
-			return true, expiration
+			expiration = now().Add(ttl)
 		}
+		return true, expiration
 	}
 
 	// isPublic only if has an explicit expiration
@@ -93,6 +306,70 @@ func getCacheableStatus(req *http.Request, response *Response, config *Config) (
 	return true, expiration
 }
 
+// getStatusTTL returns the status ttl that matches the code. If
+// many match the one with the narrowest range is used
+func getStatusTTL(code int, statusTTLs []StatusTTL) (StatusTTL, bool) {
+	found := false
+	match := StatusTTL{}
+
+	for _, statusTTL := range statusTTLs {
+		if code < statusTTL.From || code > statusTTL.To {
+			continue
+		}
+		if !found || statusTTL.To-statusTTL.From < match.To-match.From {
+			match = statusTTL
+			found = true
+		}
+	}
+
+	return match, found
+}
+
+func withoutReason(reasons []cacheobject.Reason, excluded cacheobject.Reason) []cacheobject.Reason {
+	kept := []cacheobject.Reason{}
+	for _, reason := range reasons {
+		if reason != excluded {
+			kept = append(kept, reason)
+		}
+	}
+	return kept
+}
+
+// getStaleWindows returns for how long a stale response can be served while it is refreshed
+// in background and for how long it can be served when upstream fails. The stale-while-revalidate
+// and stale-if-error directives of the response have precedence over the configured defaults
+// and must-revalidate disables both
+func getStaleWindows(headers http.Header, config *Config) (whileRevalidate time.Duration, ifError time.Duration) {
+	directives, err := cacheobject.ParseResponseCacheControl(headers.Get("Cache-Control"))
+	if err != nil || directives.MustRevalidate || directives.ProxyRevalidate {
+		return 0, 0
+	}
+
+	whileRevalidate = config.StaleWhileRevalidate
+	if directives.StaleWhileRevalidate >= 0 {
+		whileRevalidate = time.Duration(directives.StaleWhileRevalidate) * time.Second
+	}
+
+	ifError = config.StaleIfError
+	if directives.StaleIfError >= 0 {
+		ifError = time.Duration(directives.StaleIfError) * time.Second
+	}
+
+	return whileRevalidate, ifError
+}
+
+// parseTags splits a Surrogate-Key or Cache-Tag header
+// Tags can be separated by spaces or commas
+func parseTags(header string) []string {
+	return strings.FieldsFunc(header, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+}
+
+func hasValidators(headers http.Header) bool {
+	return headers.Get("ETag") != "" || headers.Get("Last-Modified") != ""
+}
+
 func matchesVary(currentRequest *http.Request, entry *HTTPCacheEntry) bool {
 	vary := entry.Response.HeaderMap.Get("Vary")
 
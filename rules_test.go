@@ -2,6 +2,7 @@ package cache
 
 import (
 	"net/http"
+	"regexp"
 	"testing"
 	"time"
 
@@ -41,6 +42,8 @@ func TestCacheableStatus(t *testing.T) {
 		&PathCacheRule{Path: "/public"},
 	}
 	testTime := time.Now()
+	previousNow := now
+	defer func() { now = previousNow }()
 	now = func() time.Time {
 		return testTime
 	}
@@ -129,6 +132,127 @@ func TestCacheableStatus(t *testing.T) {
 	})
 }
 
+func TestStatusTTL(t *testing.T) {
+	c := emptyConfig()
+	c.StatusTTLs = []StatusTTL{
+		{From: 404, To: 404, TTL: time.Duration(30) * time.Second},
+		{From: 400, To: 499, TTL: time.Duration(10) * time.Second},
+		{From: 500, To: 599, TTL: time.Duration(5) * time.Second},
+		{From: 503, To: 503, Never: true},
+	}
+	testTime := time.Now()
+	previousNow := now
+	defer func() { now = previousNow }()
+	now = func() time.Time {
+		return testTime
+	}
+
+	t.Run("should use the most specific ttl if there is no explicit expiration", func(t *testing.T) {
+		isPublic, expiration := getCacheableStatus(makeRequest("/", http.Header{}), makeResponse(404, http.Header{}), c)
+		require.True(t, isPublic)
+		require.Equal(t, testTime.Add(time.Duration(30)*time.Second), expiration)
+
+		isPublic, expiration = getCacheableStatus(makeRequest("/", http.Header{}), makeResponse(410, http.Header{}), c)
+		require.True(t, isPublic)
+		require.Equal(t, testTime.Add(time.Duration(10)*time.Second), expiration)
+	})
+
+	t.Run("should cache statuses that are not cacheable by default", func(t *testing.T) {
+		isPublic, expiration := getCacheableStatus(makeRequest("/", http.Header{}), makeResponse(502, http.Header{}), c)
+		require.True(t, isPublic)
+		require.Equal(t, testTime.Add(time.Duration(5)*time.Second), expiration)
+	})
+
+	t.Run("should use the explicit expiration", func(t *testing.T) {
+		isPublic, expiration := getCacheableStatus(makeRequest("/", http.Header{}), makeResponse(404, makeHeader("Cache-control", "max-age=50")), c)
+		require.True(t, isPublic)
+
+		// Round is required because cachecontrol library uses time.Now() inside
+		require.Equal(t, testTime.Add(time.Duration(50)*time.Second).UTC().Round(time.Second), expiration.UTC().Round(time.Second))
+	})
+
+	t.Run("should not cache private responses", func(t *testing.T) {
+		isPublic, _ := getCacheableStatus(makeRequest("/", http.Header{}), makeResponse(404, makeHeader("Cache-control", "private")), c)
+		require.False(t, isPublic)
+	})
+
+	t.Run("should never cache forbidden statuses", func(t *testing.T) {
+		isPublic, _ := getCacheableStatus(makeRequest("/", http.Header{}), makeResponse(503, makeHeader("Cache-control", "max-age=50")), c)
+		require.False(t, isPublic)
+	})
+}
+
+func TestActionCacheRules(t *testing.T) {
+	c := emptyConfig()
+	c.CacheRules = []CacheRule{
+		&ActionCacheRule{Rules: []CacheRule{&PathCacheRule{Path: "/admin"}}, Never: true},
+		&ActionCacheRule{Rules: []CacheRule{&PathCacheRule{Path: "/static"}}, TTL: time.Hour},
+		&ActionCacheRule{Rules: []CacheRule{&PathCacheRule{Path: "/legacy"}}, TTL: time.Minute, Override: true, OverridePrivate: true, OverrideNoCache: true},
+		&ActionCacheRule{Rules: []CacheRule{&PathCacheRule{Path: "/override"}}, Override: true},
+	}
+	testTime := time.Now()
+	previousNow := now
+	defer func() { now = previousNow }()
+	now = func() time.Time {
+		return testTime
+	}
+
+	t.Run("should use the rule ttl if there is no explicit expiration", func(t *testing.T) {
+		isPublic, expiration := getCacheableStatus(makeRequest("/static", http.Header{}), makeResponse(200, http.Header{}), c)
+		require.True(t, isPublic)
+		require.Equal(t, testTime.Add(time.Hour), expiration)
+	})
+
+	t.Run("should never cache matched responses", func(t *testing.T) {
+		isPublic, _ := getCacheableStatus(makeRequest("/admin", http.Header{}), makeResponse(200, makeHeader("Cache-Control", "max-age=50")), c)
+		require.False(t, isPublic)
+	})
+
+	t.Run("should override the explicit expiration", func(t *testing.T) {
+		isPublic, expiration := getCacheableStatus(makeRequest("/override", http.Header{}), makeResponse(200, makeHeader("Cache-Control", "max-age=50")), c)
+		require.True(t, isPublic)
+		require.Equal(t, testTime.Add(c.DefaultMaxAge), expiration)
+	})
+
+	t.Run("should override the configured directives", func(t *testing.T) {
+		isPublic, expiration := getCacheableStatus(makeRequest("/legacy", http.Header{}), makeResponse(200, makeHeader("Cache-Control", "private, no-cache")), c)
+		require.True(t, isPublic)
+		require.Equal(t, testTime.Add(time.Minute), expiration)
+
+		isPublic, _ = getCacheableStatus(makeRequest("/legacy", http.Header{}), makeResponse(200, makeHeader("Cache-Control", "no-store")), c)
+		require.False(t, isPublic)
+	})
+
+	t.Run("should not override directives that are not configured", func(t *testing.T) {
+		isPublic, _ := getCacheableStatus(makeRequest("/override", http.Header{}), makeResponse(200, makeHeader("Cache-Control", "private")), c)
+		require.False(t, isPublic)
+
+		isPublic, _ = getCacheableStatus(makeRequest("/override", http.Header{}), makeResponse(200, makeHeader("Cache-Control", "no-cache")), c)
+		require.False(t, isPublic)
+	})
+}
+
+func TestSetCookieResponses(t *testing.T) {
+	response := func() *Response {
+		headers := makeHeader("Cache-Control", "max-age=50")
+		headers.Set("Set-Cookie", "session=1")
+		return makeResponse(200, headers)
+	}
+
+	c := emptyConfig()
+	isPublic, _ := getCacheableStatus(makeRequest("/", http.Header{}), response(), c)
+	require.False(t, isPublic)
+
+	c.StripHeaders = []string{"set-cookie"}
+	isPublic, _ = getCacheableStatus(makeRequest("/", http.Header{}), response(), c)
+	require.True(t, isPublic)
+
+	c = emptyConfig()
+	c.AllowSetCookie = true
+	isPublic, _ = getCacheableStatus(makeRequest("/", http.Header{}), response(), c)
+	require.True(t, isPublic)
+}
+
 func TestHeaderCacheRule(t *testing.T) {
 	r := &HeaderCacheRule{
 		Header: "Content-Type",
@@ -155,3 +279,61 @@ func TestHeaderCacheRule(t *testing.T) {
 		require.False(t, matched)
 	})
 }
+
+func TestResponseCacheRules(t *testing.T) {
+	request := makeRequest("/api/v1/users", http.Header{})
+	headers := http.Header{
+		"Content-Type":   []string{"image/png"},
+		"Content-Length": []string{"2048"},
+	}
+
+	tests := []struct {
+		name    string
+		rule    CacheRule
+		matches bool
+	}{
+		{"header glob", &HeaderCacheRule{Header: "Content-Type", Value: []string{"image/*"}}, true},
+		{"header exact", &HeaderCacheRule{Header: "Content-Type", Value: []string{"image"}}, false},
+		{"status", &StatusCacheRule{Codes: []int{200, 404}}, true},
+		{"other status", &StatusCacheRule{Codes: []int{301}}, false},
+		{"path regex", &PathRegexCacheRule{Regex: regexp.MustCompile("^/api/v[0-9]+/")}, true},
+		{"header regex", &HeaderRegexCacheRule{Header: "content-type", Regex: regexp.MustCompile("^image/(png|gif)$")}, true},
+		{"header present", &HeaderPresenceCacheRule{Header: "Content-Type", Present: true}, true},
+		{"header absent", &HeaderPresenceCacheRule{Header: "Set-Cookie", Present: false}, true},
+		{"content length in range", &ContentLengthCacheRule{Min: 1024, Max: 4096}, true},
+		{"content length over max", &ContentLengthCacheRule{Max: 1024}, false},
+		{"content length without max", &ContentLengthCacheRule{Min: 1024}, true},
+		{"all", &AllCacheRule{Rules: []CacheRule{
+			&StatusCacheRule{Codes: []int{200}},
+			&PathCacheRule{Path: "/api"},
+		}}, true},
+		{"all with one not matching", &AllCacheRule{Rules: []CacheRule{
+			&StatusCacheRule{Codes: []int{200}},
+			&PathCacheRule{Path: "/assets"},
+		}}, false},
+		{"any", &AnyCacheRule{Rules: []CacheRule{
+			&StatusCacheRule{Codes: []int{404}},
+			&PathCacheRule{Path: "/api"},
+		}}, true},
+		{"not", &NotCacheRule{Rules: []CacheRule{
+			&HeaderPresenceCacheRule{Header: "Set-Cookie", Present: true},
+		}}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			require.Equal(t, test.matches, test.rule.matches(request, 200, headers))
+		})
+	}
+
+	t.Run("content length rules do not match unknown sizes", func(t *testing.T) {
+		rule := &ContentLengthCacheRule{}
+		require.False(t, rule.matches(request, 200, http.Header{}))
+	})
+}
+
+func TestParseTags(t *testing.T) {
+	require.Equal(t, []string{"a", "b", "c"}, parseTags("a b  c"))
+	require.Equal(t, []string{"a", "b", "c"}, parseTags("a, b,c"))
+	require.Equal(t, []string{}, parseTags(""))
+}
@@ -1,6 +1,13 @@
 package cache
 
 import (
+	"errors"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"os"
@@ -13,16 +20,63 @@ var (
 	defaultStatusHeader = "X-Cache-Status"
 	defaultLockTimeout  = time.Duration(5) * time.Minute
 	defaultMaxAge       = time.Duration(5) * time.Minute
+	defaultKeepStale    = time.Duration(1) * time.Hour
+	defaultGCInterval   = time.Duration(1) * time.Hour
 	defaultPath         = ""
 )
 
+const (
+	diskStorage   = "disk"
+	memoryStorage = "memory"
+)
+
 type Config struct {
-	StatusHeader     string
-	DefaultMaxAge    time.Duration
-	LockTimeout      time.Duration
-	CacheRules       []CacheRule
-	Path             string
-	CacheKeyTemplate string
+	StatusHeader         string
+	DefaultMaxAge        time.Duration
+	LockTimeout          time.Duration
+	KeepStale            time.Duration
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+	CacheRules           []CacheRule
+	Path                 string
+	CacheKeyTemplate     string
+	KeyNormalization     *KeyNormalization
+	PurgeMethod          string
+	PurgeAllow           []*net.IPNet
+	PurgeSecretHeader    string
+	PurgeSecret          string
+	TagHeader            string
+	MaxEntries           int
+	MaxDiskSize          int64
+	MaxMemorySize        int64
+	Storage              string
+	MemoryStorageMaxSize int64
+	GCInterval           time.Duration
+	GCRateLimit          int
+	MetricsPath          string
+	MetricsGroup         string
+	SiteHost             string
+	AdminPath            string
+	AdminAllow           []*net.IPNet
+	AdminSecretHeader    string
+	AdminSecret          string
+
+	IgnoreRequestCacheControl bool
+	RequestCacheControlAllow  []*net.IPNet
+
+	CacheStatusName string
+	CacheStatusKey  bool
+	Via             string
+
+	HeadAsGet bool
+
+	StatusTTLs []StatusTTL
+
+	BypassRules []BypassRule
+
+	AllowSetCookie bool
+	StripHeaders   []string
+	SetHeaders     http.Header
 }
 
 func init() {
@@ -41,15 +95,38 @@ func Setup(c *caddy.Controller) error {
 		return err
 	}
 
+	// The metrics are labeled with the host of the site instead of the one sent by the clients
+	config.SiteHost = httpserver.GetConfig(c).Host()
+
+	handler := NewHandler(nil, config)
 	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
-		return NewHandler(next, config)
+		handler.Next = next
+		return handler
 	})
 
 	c.OnStartup(func() error {
 		if config.Path == "" {
 			return nil
 		}
-		return os.MkdirAll(config.Path, 0600)
+		if err := os.MkdirAll(config.Path, 0600); err != nil {
+			return err
+		}
+
+		// Entries are only persisted in a configured path because
+		// the temp folder can be shared with other caches
+		if _, err := handler.Cache.Restore(config.Path); err != nil {
+			return err
+		}
+
+		if config.GCInterval > 0 {
+			handler.Cache.StartGC(config.Path, config.GCInterval, config.GCRateLimit)
+		}
+		return nil
+	})
+
+	c.OnShutdown(func() error {
+		handler.Cache.Close()
+		return nil
 	})
 
 	return nil
@@ -64,6 +141,8 @@ func emptyConfig() *Config {
 		StatusHeader:     defaultStatusHeader,
 		DefaultMaxAge:    defaultMaxAge,
 		LockTimeout:      defaultLockTimeout,
+		KeepStale:        defaultKeepStale,
+		GCInterval:       defaultGCInterval,
 		CacheRules:       []CacheRule{},
 		Path:             defaultPath,
 		CacheKeyTemplate: defaultCacheKeyTemplate,
@@ -89,6 +168,9 @@ func cacheParse(c *caddy.Controller) (*Config, error) {
 				return nil, c.Err("Invalid usage of status_header in cache config.")
 			}
 			config.StatusHeader = args[0]
+			if args[0] == "off" {
+				config.StatusHeader = ""
+			}
 		case "lock_timeout":
 			if len(args) != 1 {
 				return nil, c.Err("Invalid usage of lock_timeout in cache config.")
@@ -107,32 +189,619 @@ func cacheParse(c *caddy.Controller) (*Config, error) {
 				return nil, c.Err("default_max_age: Invalid duration " + c.Val())
 			}
 			config.DefaultMaxAge = duration
+		case "keep_stale":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of keep_stale in cache config.")
+			}
+			duration, err := time.ParseDuration(c.Val())
+			if err != nil {
+				return nil, c.Err("keep_stale: Invalid duration " + c.Val())
+			}
+			config.KeepStale = duration
+		case "stale_while_revalidate":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of stale_while_revalidate in cache config.")
+			}
+			duration, err := time.ParseDuration(c.Val())
+			if err != nil {
+				return nil, c.Err("stale_while_revalidate: Invalid duration " + c.Val())
+			}
+			config.StaleWhileRevalidate = duration
+		case "stale_if_error":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of stale_if_error in cache config.")
+			}
+			duration, err := time.ParseDuration(c.Val())
+			if err != nil {
+				return nil, c.Err("stale_if_error: Invalid duration " + c.Val())
+			}
+			config.StaleIfError = duration
 		case "path":
 			if len(args) != 1 {
 				return nil, c.Err("Invalid usage of path in cache config.")
 			}
 			config.Path = args[0]
-		case "match_header":
-			if len(args) < 2 {
-				return nil, c.Err("Invalid usage of match_header in cache config.")
+		case "match_header", "match_path", "match_status", "match_path_regex", "match_header_regex",
+			"match_header_present", "match_header_absent", "match_content_length", "match_all", "match_any", "match_not":
+			cacheRule, err := parseCacheRule(c, parameter, args)
+			if err != nil {
+				return nil, err
 			}
-			cacheRule := &HeaderCacheRule{Header: args[0], Value: args[1:]}
 			config.CacheRules = append(config.CacheRules, cacheRule)
-		case "match_path":
-			if len(args) != 1 {
-				return nil, c.Err("Invalid usage of match_path in cache config.")
+		case "rule":
+			if len(args) != 0 {
+				return nil, c.Err("Invalid usage of rule in cache config.")
+			}
+			cacheRule, err := parseActionRule(c)
+			if err != nil {
+				return nil, err
 			}
-			cacheRule := &PathCacheRule{Path: args[0]}
 			config.CacheRules = append(config.CacheRules, cacheRule)
+		case "allow_set_cookie":
+			if len(args) != 0 {
+				return nil, c.Err("Invalid usage of allow_set_cookie in cache config.")
+			}
+			config.AllowSetCookie = true
+		case "strip_header":
+			if len(args) == 0 {
+				return nil, c.Err("Invalid usage of strip_header in cache config.")
+			}
+			config.StripHeaders = append(config.StripHeaders, args...)
+		case "set_header":
+			if len(args) != 2 {
+				return nil, c.Err("Invalid usage of set_header in cache config.")
+			}
+			if config.SetHeaders == nil {
+				config.SetHeaders = http.Header{}
+			}
+			config.SetHeaders.Add(args[0], args[1])
+		case "status_ttl":
+			if len(args) != 2 {
+				return nil, c.Err("Invalid usage of status_ttl in cache config.")
+			}
+			statusTTL, err := parseStatusTTL(args[0], args[1])
+			if err != nil {
+				return nil, c.Err("status_ttl: " + err.Error())
+			}
+			config.StatusTTLs = append(config.StatusTTLs, statusTTL)
+		case "bypass":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of bypass in cache config.")
+			}
+			rule, err := parseBypassRule(c, args[0])
+			if err != nil {
+				return nil, err
+			}
+			config.BypassRules = append(config.BypassRules, rule)
 		case "cache_key":
 			if len(args) != 1 {
 				return nil, c.Err("Invalid usage of cache_key in cache config.")
 			}
 			config.CacheKeyTemplate = args[0]
+		case "key_sort_query", "key_lowercase_host", "key_merge_slashes":
+			if len(args) != 0 {
+				return nil, c.Err("Invalid usage of " + parameter + " in cache config.")
+			}
+			normalization := keyNormalization(config)
+			switch parameter {
+			case "key_sort_query":
+				normalization.SortQuery = true
+			case "key_lowercase_host":
+				normalization.LowercaseHost = true
+			default:
+				normalization.MergeSlashes = true
+			}
+		case "key_ignore_params", "key_keep_params":
+			if len(args) == 0 {
+				return nil, c.Err("Invalid usage of " + parameter + " in cache config.")
+			}
+			for _, pattern := range args {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return nil, c.Err(parameter + ": Invalid pattern " + pattern)
+				}
+			}
+			normalization := keyNormalization(config)
+			if parameter == "key_ignore_params" {
+				normalization.IgnoreParams = append(normalization.IgnoreParams, args...)
+			} else {
+				normalization.KeepParams = append(normalization.KeepParams, args...)
+			}
+		case "purge_method":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of purge_method in cache config.")
+			}
+			config.PurgeMethod = strings.ToUpper(args[0])
+		case "purge_allow":
+			if len(args) == 0 {
+				return nil, c.Err("Invalid usage of purge_allow in cache config.")
+			}
+			networks, err := parseNetworks(args)
+			if err != nil {
+				return nil, c.Err("purge_allow: " + err.Error())
+			}
+			config.PurgeAllow = append(config.PurgeAllow, networks...)
+		case "purge_secret":
+			if len(args) != 2 {
+				return nil, c.Err("Invalid usage of purge_secret in cache config.")
+			}
+			config.PurgeSecretHeader = args[0]
+			config.PurgeSecret = args[1]
+		case "tag_header":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of tag_header in cache config.")
+			}
+			config.TagHeader = args[0]
+		case "max_entries":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of max_entries in cache config.")
+			}
+			maxEntries, err := strconv.Atoi(args[0])
+			if err != nil || maxEntries < 0 {
+				return nil, c.Err("max_entries: Invalid number " + args[0])
+			}
+			config.MaxEntries = maxEntries
+		case "max_disk_size":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of max_disk_size in cache config.")
+			}
+			size, err := parseSize(args[0])
+			if err != nil {
+				return nil, c.Err("max_disk_size: Invalid size " + args[0])
+			}
+			config.MaxDiskSize = size
+		case "max_memory_size":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of max_memory_size in cache config.")
+			}
+			size, err := parseSize(args[0])
+			if err != nil {
+				return nil, c.Err("max_memory_size: Invalid size " + args[0])
+			}
+			config.MaxMemorySize = size
+		case "gc_interval":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of gc_interval in cache config.")
+			}
+			duration, err := time.ParseDuration(c.Val())
+			if err != nil {
+				return nil, c.Err("gc_interval: Invalid duration " + c.Val())
+			}
+			config.GCInterval = duration
+		case "gc_rate_limit":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of gc_rate_limit in cache config.")
+			}
+			rateLimit, err := strconv.Atoi(args[0])
+			if err != nil || rateLimit < 0 {
+				return nil, c.Err("gc_rate_limit: Invalid number " + args[0])
+			}
+			config.GCRateLimit = rateLimit
+		case "metrics_path":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of metrics_path in cache config.")
+			}
+			config.MetricsPath = args[0]
+		case "metrics_group":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of metrics_group in cache config.")
+			}
+			config.MetricsGroup = args[0]
+		case "admin_path":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of admin_path in cache config.")
+			}
+			config.AdminPath = args[0]
+		case "admin_allow":
+			if len(args) == 0 {
+				return nil, c.Err("Invalid usage of admin_allow in cache config.")
+			}
+			networks, err := parseNetworks(args)
+			if err != nil {
+				return nil, c.Err("admin_allow: " + err.Error())
+			}
+			config.AdminAllow = append(config.AdminAllow, networks...)
+		case "admin_secret":
+			if len(args) != 2 {
+				return nil, c.Err("Invalid usage of admin_secret in cache config.")
+			}
+			config.AdminSecretHeader = args[0]
+			config.AdminSecret = args[1]
+		case "request_cache_control":
+			if len(args) == 0 {
+				return nil, c.Err("Invalid usage of request_cache_control in cache config.")
+			}
+			if len(args) == 1 && args[0] == "off" {
+				config.IgnoreRequestCacheControl = true
+				break
+			}
+			networks, err := parseNetworks(args)
+			if err != nil {
+				return nil, c.Err("request_cache_control: " + err.Error())
+			}
+			config.RequestCacheControlAllow = append(config.RequestCacheControlAllow, networks...)
+		case "cache_status":
+			if len(args) == 0 || len(args) > 2 || (len(args) == 2 && args[1] != "key") {
+				return nil, c.Err("Invalid usage of cache_status in cache config.")
+			}
+			config.CacheStatusName = args[0]
+			config.CacheStatusKey = len(args) == 2
+		case "via":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of via in cache config.")
+			}
+			config.Via = args[0]
+		case "head_as_get":
+			if len(args) != 0 {
+				return nil, c.Err("Invalid usage of head_as_get in cache config.")
+			}
+			config.HeadAsGet = true
+		case "storage":
+			if len(args) < 1 || len(args) > 2 || (args[0] != diskStorage && args[0] != memoryStorage) {
+				return nil, c.Err("Invalid usage of storage in cache config.")
+			}
+			if len(args) == 2 {
+				if args[0] != memoryStorage {
+					return nil, c.Err("storage: Only memory storage accepts a max size")
+				}
+				size, err := parseSize(args[1])
+				if err != nil {
+					return nil, c.Err("storage: Invalid size " + args[1])
+				}
+				config.MemoryStorageMaxSize = size
+			}
+			config.Storage = args[0]
 		default:
 			return nil, c.Err("Unknown cache parameter: " + parameter)
 		}
 	}
 
+	if config.PurgeMethod != "" && len(config.PurgeAllow) == 0 && config.PurgeSecretHeader == "" {
+		return nil, c.Err("purge_method requires purge_allow or purge_secret to restrict who can purge")
+	}
+
+	if config.AdminPath != "" && len(config.AdminAllow) == 0 && config.AdminSecretHeader == "" {
+		return nil, c.Err("admin_path requires admin_allow or admin_secret to restrict who can inspect the cache")
+	}
+
 	return config, nil
 }
+
+// parseCacheRule parses a match parameter. The match_all, match_any and
+// match_not groups have a block of rules that can have other groups
+func parseCacheRule(c *caddy.Controller, parameter string, args []string) (CacheRule, error) {
+	invalid := c.Err("Invalid usage of " + parameter + " in cache config.")
+
+	switch parameter {
+	case "match_header":
+		if len(args) < 2 {
+			return nil, invalid
+		}
+		return &HeaderCacheRule{Header: args[0], Value: args[1:]}, nil
+	case "match_path":
+		if len(args) != 1 {
+			return nil, invalid
+		}
+		return &PathCacheRule{Path: args[0]}, nil
+	case "match_status":
+		if len(args) == 0 {
+			return nil, invalid
+		}
+		codes := []int{}
+		for _, arg := range args {
+			code, err := strconv.Atoi(arg)
+			if err != nil || code < 100 || code > 599 {
+				return nil, c.Err("match_status: Invalid status " + arg)
+			}
+			codes = append(codes, code)
+		}
+		return &StatusCacheRule{Codes: codes}, nil
+	case "match_path_regex":
+		if len(args) != 1 {
+			return nil, invalid
+		}
+		regex, err := regexp.Compile(args[0])
+		if err != nil {
+			return nil, c.Err("match_path_regex: Invalid regular expression " + args[0])
+		}
+		return &PathRegexCacheRule{Regex: regex}, nil
+	case "match_header_regex":
+		if len(args) != 2 {
+			return nil, invalid
+		}
+		regex, err := regexp.Compile(args[1])
+		if err != nil {
+			return nil, c.Err("match_header_regex: Invalid regular expression " + args[1])
+		}
+		return &HeaderRegexCacheRule{Header: args[0], Regex: regex}, nil
+	case "match_header_present", "match_header_absent":
+		if len(args) != 1 {
+			return nil, invalid
+		}
+		return &HeaderPresenceCacheRule{Header: args[0], Present: parameter == "match_header_present"}, nil
+	case "match_content_length":
+		if len(args) < 1 || len(args) > 2 {
+			return nil, invalid
+		}
+		rule := &ContentLengthCacheRule{}
+		for i, arg := range args {
+			size, err := parseSize(arg)
+			if err != nil {
+				return nil, c.Err("match_content_length: Invalid size " + arg)
+			}
+			if i == 0 {
+				rule.Min = size
+			} else {
+				rule.Max = size
+			}
+		}
+		if rule.Max != 0 && rule.Max < rule.Min {
+			return nil, c.Err("match_content_length: The max size is lower than the min size")
+		}
+		return rule, nil
+	case "match_all", "match_any", "match_not":
+		if len(args) != 0 {
+			return nil, invalid
+		}
+		rules, err := parseCacheRuleGroup(c, parameter)
+		if err != nil {
+			return nil, err
+		}
+		switch parameter {
+		case "match_all":
+			return &AllCacheRule{Rules: rules}, nil
+		case "match_any":
+			return &AnyCacheRule{Rules: rules}, nil
+		default:
+			return &NotCacheRule{Rules: rules}, nil
+		}
+	}
+
+	return nil, c.Err("Unknown cache rule: " + parameter)
+}
+
+// parseActionRule parses a rule block, it has match rules and the
+// ttl, override and never_cache actions
+func parseActionRule(c *caddy.Controller) (*ActionCacheRule, error) {
+	if !c.NextArg() || c.Val() != "{" {
+		return nil, c.Err("rule: Expected a block")
+	}
+
+	rule := &ActionCacheRule{Rules: []CacheRule{}}
+	for c.Next() {
+		parameter := c.Val()
+		if parameter == "}" {
+			if len(rule.Rules) == 0 {
+				return nil, c.Err("rule: The block has no match rules")
+			}
+			if rule.Never && (rule.Override || rule.TTL > 0) {
+				return nil, c.Err("rule: never_cache can not be used with ttl or override")
+			}
+			return rule, nil
+		}
+
+		args := c.RemainingArgs()
+		switch parameter {
+		case "ttl":
+			if len(args) != 1 {
+				return nil, c.Err("rule: Invalid usage of ttl")
+			}
+			duration, err := time.ParseDuration(args[0])
+			if err != nil || duration <= 0 {
+				return nil, c.Err("rule: Invalid duration " + args[0])
+			}
+			rule.TTL = duration
+		case "override":
+			rule.Override = true
+			for _, directive := range args {
+				switch directive {
+				case "private":
+					rule.OverridePrivate = true
+				case "no-cache":
+					rule.OverrideNoCache = true
+				case "no-store":
+					rule.OverrideNoStore = true
+				default:
+					return nil, c.Err("rule: override only accepts private, no-cache and no-store")
+				}
+			}
+		case "never_cache":
+			if len(args) != 0 {
+				return nil, c.Err("rule: Invalid usage of never_cache")
+			}
+			rule.Never = true
+		default:
+			if !strings.HasPrefix(parameter, "match_") {
+				return nil, c.Err("rule: Unknown parameter " + parameter)
+			}
+			cacheRule, err := parseCacheRule(c, parameter, args)
+			if err != nil {
+				return nil, err
+			}
+			rule.Rules = append(rule.Rules, cacheRule)
+		}
+	}
+
+	return nil, c.Err("rule: Unclosed block")
+}
+
+// parseCacheRuleGroup parses the block of rules of a group
+// The dispenser does not support nested blocks so it is read by hand
+func parseCacheRuleGroup(c *caddy.Controller, parameter string) ([]CacheRule, error) {
+	if !c.NextArg() || c.Val() != "{" {
+		return nil, c.Err(parameter + ": Expected a block of rules")
+	}
+
+	rules := []CacheRule{}
+	for c.Next() {
+		if c.Val() == "}" {
+			if len(rules) == 0 {
+				return nil, c.Err(parameter + ": The block has no rules")
+			}
+			return rules, nil
+		}
+
+		name := c.Val()
+		rule, err := parseCacheRule(c, name, c.RemainingArgs())
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	return nil, c.Err(parameter + ": Unclosed block")
+}
+
+// parseBypassRule parses the block of conditions of a bypass rule
+// The dispenser does not support nested blocks so it is read by hand
+func parseBypassRule(c *caddy.Controller, name string) (BypassRule, error) {
+	rule := BypassRule{Name: name}
+
+	if !c.NextArg() || c.Val() != "{" {
+		return rule, c.Err("bypass: Expected a block of conditions")
+	}
+
+	for c.Next() {
+		condition := c.Val()
+		if condition == "}" {
+			if len(rule.Conditions) == 0 {
+				return rule, c.Err("bypass: " + name + " has no conditions")
+			}
+			return rule, nil
+		}
+
+		args := c.RemainingArgs()
+		switch condition {
+		case "cookie", "header", "query":
+			if len(args) < 1 || len(args) > 2 {
+				return rule, c.Err("bypass: Invalid usage of " + condition)
+			}
+			value := ""
+			if len(args) == 2 {
+				value = args[1]
+			}
+			switch condition {
+			case "cookie":
+				rule.Conditions = append(rule.Conditions, &CookieBypassCondition{Name: args[0], Value: value})
+			case "header":
+				rule.Conditions = append(rule.Conditions, &HeaderBypassCondition{Header: args[0], Value: value})
+			default:
+				rule.Conditions = append(rule.Conditions, &QueryBypassCondition{Param: args[0], Value: value})
+			}
+		case "path":
+			if len(args) == 0 {
+				return rule, c.Err("bypass: Invalid usage of path")
+			}
+			rule.Conditions = append(rule.Conditions, &PathBypassCondition{Globs: args})
+		case "ip":
+			if len(args) == 0 {
+				return rule, c.Err("bypass: Invalid usage of ip")
+			}
+			networks, err := parseNetworks(args)
+			if err != nil {
+				return rule, c.Err("bypass: " + err.Error())
+			}
+			rule.Conditions = append(rule.Conditions, &IPBypassCondition{Networks: networks})
+		case "method":
+			if len(args) == 0 {
+				return rule, c.Err("bypass: Invalid usage of method")
+			}
+			methods := []string{}
+			for _, method := range args {
+				methods = append(methods, strings.ToUpper(method))
+			}
+			rule.Conditions = append(rule.Conditions, &MethodBypassCondition{Methods: methods})
+		default:
+			return rule, c.Err("bypass: Unknown condition " + condition)
+		}
+	}
+
+	return rule, c.Err("bypass: Unclosed block")
+}
+
+// keyNormalization returns the key normalization of the config
+// creating it the first time a normalization parameter is used
+func keyNormalization(config *Config) *KeyNormalization {
+	if config.KeyNormalization == nil {
+		config.KeyNormalization = &KeyNormalization{}
+	}
+	return config.KeyNormalization
+}
+
+// parseStatusTTL parses a status code or a class like 5xx
+// and a duration or never to not cache them
+func parseStatusTTL(status string, ttl string) (StatusTTL, error) {
+	statusTTL := StatusTTL{}
+
+	if len(status) == 3 && strings.HasSuffix(strings.ToLower(status), "xx") {
+		class, err := strconv.Atoi(status[:1])
+		if err != nil || class < 1 || class > 5 {
+			return statusTTL, errors.New("Invalid status " + status)
+		}
+		statusTTL.From = class * 100
+		statusTTL.To = class*100 + 99
+	} else {
+		code, err := strconv.Atoi(status)
+		if err != nil || code < 100 || code > 599 {
+			return statusTTL, errors.New("Invalid status " + status)
+		}
+		statusTTL.From = code
+		statusTTL.To = code
+	}
+
+	if ttl == "never" {
+		statusTTL.Never = true
+		return statusTTL, nil
+	}
+
+	duration, err := time.ParseDuration(ttl)
+	if err != nil || duration <= 0 {
+		return statusTTL, errors.New("Invalid duration " + ttl)
+	}
+	statusTTL.TTL = duration
+
+	return statusTTL, nil
+}
+
+// parseNetworks parses a list of IPs or ranges in CIDR notation
+func parseNetworks(values []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, value := range values {
+		network, err := parseNetwork(value)
+		if err != nil {
+			return nil, errors.New("Invalid IP range " + value)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+var sizeUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// parseSize parses a number of bytes that can have a B, KB, MB or GB suffix
+func parseSize(value string) (int64, error) {
+	upper := strings.ToUpper(value)
+	multiplier := int64(1)
+
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(upper, unit.suffix) {
+			upper = strings.TrimSuffix(upper, unit.suffix)
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	size, err := strconv.ParseInt(strings.TrimSpace(upper), 10, 64)
+	if err != nil || size < 0 {
+		return 0, errors.New("Invalid size " + value)
+	}
+
+	return size * multiplier, nil
+}
@@ -1,6 +1,9 @@
 package cache
 
 import (
+	"net"
+	"net/http"
+	"regexp"
 	"strconv"
 	"testing"
 	"time"
@@ -9,6 +12,14 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+func mustParseNetwork(value string) *net.IPNet {
+	network, err := parseNetwork(value)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
 func TestParsingConfig(t *testing.T) {
 	tests := []struct {
 		input     string
@@ -19,6 +30,8 @@ func TestParsingConfig(t *testing.T) {
 			StatusHeader:     defaultStatusHeader,
 			LockTimeout:      defaultLockTimeout,
 			DefaultMaxAge:    defaultMaxAge,
+			KeepStale:        defaultKeepStale,
+			GCInterval:       defaultGCInterval,
 			CacheRules:       []CacheRule{},
 			CacheKeyTemplate: defaultCacheKeyTemplate,
 		}},
@@ -26,6 +39,8 @@ func TestParsingConfig(t *testing.T) {
 			StatusHeader:     defaultStatusHeader,
 			LockTimeout:      defaultLockTimeout,
 			DefaultMaxAge:    defaultMaxAge,
+			KeepStale:        defaultKeepStale,
+			GCInterval:       defaultGCInterval,
 			CacheRules:       []CacheRule{&PathCacheRule{Path: "/assets"}},
 			CacheKeyTemplate: defaultCacheKeyTemplate,
 		}},
@@ -33,6 +48,8 @@ func TestParsingConfig(t *testing.T) {
 			StatusHeader:  defaultStatusHeader,
 			LockTimeout:   defaultLockTimeout,
 			DefaultMaxAge: defaultMaxAge,
+			KeepStale:     defaultKeepStale,
+			GCInterval:    defaultGCInterval,
 			CacheRules: []CacheRule{
 				&PathCacheRule{Path: "/assets"},
 				&PathCacheRule{Path: "/api"},
@@ -43,6 +60,8 @@ func TestParsingConfig(t *testing.T) {
 			StatusHeader:  defaultStatusHeader,
 			LockTimeout:   defaultLockTimeout,
 			DefaultMaxAge: defaultMaxAge,
+			KeepStale:     defaultKeepStale,
+			GCInterval:    defaultGCInterval,
 			CacheRules: []CacheRule{
 				&HeaderCacheRule{Header: "Content-Type", Value: []string{"image/png", "image/gif"}},
 				&PathCacheRule{Path: "/assets"},
@@ -53,6 +72,8 @@ func TestParsingConfig(t *testing.T) {
 			StatusHeader:     "X-Custom-Header",
 			LockTimeout:      defaultLockTimeout,
 			DefaultMaxAge:    defaultMaxAge,
+			KeepStale:        defaultKeepStale,
+			GCInterval:       defaultGCInterval,
 			CacheRules:       []CacheRule{},
 			CacheKeyTemplate: defaultCacheKeyTemplate,
 		}},
@@ -60,6 +81,8 @@ func TestParsingConfig(t *testing.T) {
 			StatusHeader:     defaultStatusHeader,
 			LockTimeout:      defaultLockTimeout,
 			DefaultMaxAge:    defaultMaxAge,
+			KeepStale:        defaultKeepStale,
+			GCInterval:       defaultGCInterval,
 			CacheRules:       []CacheRule{},
 			Path:             "/tmp/caddy",
 			CacheKeyTemplate: defaultCacheKeyTemplate,
@@ -68,6 +91,8 @@ func TestParsingConfig(t *testing.T) {
 			StatusHeader:     defaultStatusHeader,
 			LockTimeout:      time.Duration(1) * time.Second,
 			DefaultMaxAge:    defaultMaxAge,
+			KeepStale:        defaultKeepStale,
+			GCInterval:       defaultGCInterval,
 			CacheRules:       []CacheRule{},
 			CacheKeyTemplate: defaultCacheKeyTemplate,
 		}},
@@ -75,6 +100,8 @@ func TestParsingConfig(t *testing.T) {
 			StatusHeader:     defaultStatusHeader,
 			LockTimeout:      defaultLockTimeout,
 			DefaultMaxAge:    time.Duration(1) * time.Hour,
+			KeepStale:        defaultKeepStale,
+			GCInterval:       defaultGCInterval,
 			CacheRules:       []CacheRule{},
 			CacheKeyTemplate: defaultCacheKeyTemplate,
 		}},
@@ -82,19 +109,334 @@ func TestParsingConfig(t *testing.T) {
 			StatusHeader:     defaultStatusHeader,
 			LockTimeout:      defaultLockTimeout,
 			DefaultMaxAge:    defaultMaxAge,
+			KeepStale:        defaultKeepStale,
+			GCInterval:       defaultGCInterval,
 			CacheRules:       []CacheRule{},
 			CacheKeyTemplate: "{scheme} {host}{uri}",
 		}},
-		{"cache {\n match_header aheader \n}", true, Config{}},          // match_header without value
-		{"cache {\n lock_timeout aheader \n}", true, Config{}},          // lock_timeout with invalid duration
-		{"cache {\n lock_timeout \n}", true, Config{}},                  // lock_timeout has no arguments
-		{"cache {\n default_max_age somevalue \n}", true, Config{}},     // lock_timeout has invalid duration
-		{"cache {\n default_max_age \n}", true, Config{}},               // default_max_age has no arguments
-		{"cache {\n status_header aheader another \n}", true, Config{}}, // status_header with invalid number of parameters
-		{"cache {\n match_path / ea \n}", true, Config{}},               // Invalid number of parameters in match
-		{"cache {\n invalid / ea \n}", true, Config{}},                  // Invalid directive
-		{"cache {\n path \n}", true, Config{}},                          // Path without arguments
-		{"cache {\n cache_key \n}", true, Config{}},                     // cache_key without arguments
+		{"cache {\n keep_stale 10m \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			KeepStale:        time.Duration(10) * time.Minute,
+			GCInterval:       defaultGCInterval,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+		}},
+		{"cache {\n stale_while_revalidate 30s \n}", false, Config{
+			StatusHeader:         defaultStatusHeader,
+			LockTimeout:          defaultLockTimeout,
+			DefaultMaxAge:        defaultMaxAge,
+			KeepStale:            defaultKeepStale,
+			GCInterval:           defaultGCInterval,
+			StaleWhileRevalidate: time.Duration(30) * time.Second,
+			CacheRules:           []CacheRule{},
+			CacheKeyTemplate:     defaultCacheKeyTemplate,
+		}},
+		{"cache {\n stale_if_error 1h \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			KeepStale:        defaultKeepStale,
+			GCInterval:       defaultGCInterval,
+			StaleIfError:     time.Duration(1) * time.Hour,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+		}},
+		{"cache {\n purge_method purge \n purge_allow 127.0.0.1 10.0.0.0/8 \n purge_secret X-Purge-Token s3cr3t \n}", false, Config{
+			StatusHeader:      defaultStatusHeader,
+			LockTimeout:       defaultLockTimeout,
+			DefaultMaxAge:     defaultMaxAge,
+			KeepStale:         defaultKeepStale,
+			GCInterval:        defaultGCInterval,
+			CacheRules:        []CacheRule{},
+			CacheKeyTemplate:  defaultCacheKeyTemplate,
+			PurgeMethod:       "PURGE",
+			PurgeAllow:        []*net.IPNet{mustParseNetwork("127.0.0.1"), mustParseNetwork("10.0.0.0/8")},
+			PurgeSecretHeader: "X-Purge-Token",
+			PurgeSecret:       "s3cr3t",
+		}},
+		{"cache {\n tag_header Surrogate-Key \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			KeepStale:        defaultKeepStale,
+			GCInterval:       defaultGCInterval,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			TagHeader:        "Surrogate-Key",
+		}},
+		{"cache {\n max_entries 1000 \n max_disk_size 2GB \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			KeepStale:        defaultKeepStale,
+			GCInterval:       defaultGCInterval,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxEntries:       1000,
+			MaxDiskSize:      2 << 30,
+		}},
+		{"cache {\n storage memory 1MB \n}", false, Config{
+			StatusHeader:         defaultStatusHeader,
+			LockTimeout:          defaultLockTimeout,
+			DefaultMaxAge:        defaultMaxAge,
+			KeepStale:            defaultKeepStale,
+			GCInterval:           defaultGCInterval,
+			CacheRules:           []CacheRule{},
+			CacheKeyTemplate:     defaultCacheKeyTemplate,
+			Storage:              "memory",
+			MemoryStorageMaxSize: 1 << 20,
+		}},
+		{"cache {\n storage memory \n max_memory_size 64MB \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			KeepStale:        defaultKeepStale,
+			GCInterval:       defaultGCInterval,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			Storage:          "memory",
+			MaxMemorySize:    64 << 20,
+		}},
+		{"cache {\n gc_interval 10m \n gc_rate_limit 50 \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			KeepStale:        defaultKeepStale,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			GCInterval:       time.Duration(10) * time.Minute,
+			GCRateLimit:      50,
+		}},
+		{"cache {\n metrics_path /cache-metrics \n metrics_group assets \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			KeepStale:        defaultKeepStale,
+			GCInterval:       defaultGCInterval,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MetricsPath:      "/cache-metrics",
+			MetricsGroup:     "assets",
+		}},
+		{"cache {\n admin_path /cache-admin \n admin_allow 127.0.0.1 \n admin_secret X-Admin-Token s3cr3t \n}", false, Config{
+			StatusHeader:      defaultStatusHeader,
+			LockTimeout:       defaultLockTimeout,
+			DefaultMaxAge:     defaultMaxAge,
+			KeepStale:         defaultKeepStale,
+			GCInterval:        defaultGCInterval,
+			CacheRules:        []CacheRule{},
+			CacheKeyTemplate:  defaultCacheKeyTemplate,
+			AdminPath:         "/cache-admin",
+			AdminAllow:        []*net.IPNet{mustParseNetwork("127.0.0.1")},
+			AdminSecretHeader: "X-Admin-Token",
+			AdminSecret:       "s3cr3t",
+		}},
+		{"cache {\n request_cache_control 10.0.0.0/8 \n}", false, Config{
+			StatusHeader:             defaultStatusHeader,
+			LockTimeout:              defaultLockTimeout,
+			DefaultMaxAge:            defaultMaxAge,
+			KeepStale:                defaultKeepStale,
+			GCInterval:               defaultGCInterval,
+			CacheRules:               []CacheRule{},
+			CacheKeyTemplate:         defaultCacheKeyTemplate,
+			RequestCacheControlAllow: []*net.IPNet{mustParseNetwork("10.0.0.0/8")},
+		}},
+		{"cache {\n request_cache_control off \n}", false, Config{
+			StatusHeader:              defaultStatusHeader,
+			LockTimeout:               defaultLockTimeout,
+			DefaultMaxAge:             defaultMaxAge,
+			KeepStale:                 defaultKeepStale,
+			GCInterval:                defaultGCInterval,
+			CacheRules:                []CacheRule{},
+			CacheKeyTemplate:          defaultCacheKeyTemplate,
+			IgnoreRequestCacheControl: true,
+		}},
+		{"cache {\n status_header off \n cache_status edge key \n via edge-1 \n}", false, Config{
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			KeepStale:        defaultKeepStale,
+			GCInterval:       defaultGCInterval,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			CacheStatusName:  "edge",
+			CacheStatusKey:   true,
+			Via:              "edge-1",
+		}},
+		{"cache {\n head_as_get \n}", false, Config{
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			KeepStale:        defaultKeepStale,
+			GCInterval:       defaultGCInterval,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			StatusHeader:     defaultStatusHeader,
+			HeadAsGet:        true,
+		}},
+		{"cache {\n status_ttl 404 30s \n status_ttl 5xx never \n}", false, Config{
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			KeepStale:        defaultKeepStale,
+			GCInterval:       defaultGCInterval,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			StatusHeader:     defaultStatusHeader,
+			StatusTTLs: []StatusTTL{
+				{From: 404, To: 404, TTL: time.Duration(30) * time.Second},
+				{From: 500, To: 599, Never: true},
+			},
+		}},
+		{"cache {\n key_sort_query \n key_ignore_params utm_* fbclid \n key_keep_params id \n key_lowercase_host \n key_merge_slashes \n}", false, Config{
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			KeepStale:        defaultKeepStale,
+			GCInterval:       defaultGCInterval,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			StatusHeader:     defaultStatusHeader,
+			KeyNormalization: &KeyNormalization{
+				SortQuery:     true,
+				IgnoreParams:  []string{"utm_*", "fbclid"},
+				KeepParams:    []string{"id"},
+				LowercaseHost: true,
+				MergeSlashes:  true,
+			},
+		}},
+		{"cache {\n bypass logged_in {\n cookie session_id \n header Authorization \n } \n bypass preview { \n query preview 1 \n path /drafts/* \n ip 10.0.0.0/8 \n method get \n } \n status_header X-Cache \n}", false, Config{
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			KeepStale:        defaultKeepStale,
+			GCInterval:       defaultGCInterval,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			StatusHeader:     "X-Cache",
+			BypassRules: []BypassRule{
+				{Name: "logged_in", Conditions: []BypassCondition{
+					&CookieBypassCondition{Name: "session_id"},
+					&HeaderBypassCondition{Header: "Authorization"},
+				}},
+				{Name: "preview", Conditions: []BypassCondition{
+					&QueryBypassCondition{Param: "preview", Value: "1"},
+					&PathBypassCondition{Globs: []string{"/drafts/*"}},
+					&IPBypassCondition{Networks: []*net.IPNet{mustParseNetwork("10.0.0.0/8")}},
+					&MethodBypassCondition{Methods: []string{"GET"}},
+				}},
+			},
+		}},
+		{"cache {\n match_status 200 301 \n match_all {\n match_path_regex ^/api/v[0-9]+/ \n match_header_regex Content-Type ^application/json \n match_not {\n match_header_present Set-Cookie \n match_content_length 0 1MB \n } \n } \n match_any {\n match_header_absent Authorization \n match_content_length 10KB \n } \n}", false, Config{
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			KeepStale:        defaultKeepStale,
+			GCInterval:       defaultGCInterval,
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			StatusHeader:     defaultStatusHeader,
+			CacheRules: []CacheRule{
+				&StatusCacheRule{Codes: []int{200, 301}},
+				&AllCacheRule{Rules: []CacheRule{
+					&PathRegexCacheRule{Regex: regexp.MustCompile("^/api/v[0-9]+/")},
+					&HeaderRegexCacheRule{Header: "Content-Type", Regex: regexp.MustCompile("^application/json")},
+					&NotCacheRule{Rules: []CacheRule{
+						&HeaderPresenceCacheRule{Header: "Set-Cookie", Present: true},
+						&ContentLengthCacheRule{Min: 0, Max: 1 << 20},
+					}},
+				}},
+				&AnyCacheRule{Rules: []CacheRule{
+					&HeaderPresenceCacheRule{Header: "Authorization", Present: false},
+					&ContentLengthCacheRule{Min: 10 << 10},
+				}},
+			},
+		}},
+		{"cache {\n rule {\n match_path /api/static \n match_header Content-Type application/json \n ttl 1h \n override private no-cache \n } \n rule {\n match_path /admin \n never_cache \n } \n}", false, Config{
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			KeepStale:        defaultKeepStale,
+			GCInterval:       defaultGCInterval,
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			StatusHeader:     defaultStatusHeader,
+			CacheRules: []CacheRule{
+				&ActionCacheRule{
+					Rules: []CacheRule{
+						&PathCacheRule{Path: "/api/static"},
+						&HeaderCacheRule{Header: "Content-Type", Value: []string{"application/json"}},
+					},
+					TTL:             time.Duration(1) * time.Hour,
+					Override:        true,
+					OverridePrivate: true,
+					OverrideNoCache: true,
+				},
+				&ActionCacheRule{
+					Rules: []CacheRule{&PathCacheRule{Path: "/admin"}},
+					Never: true,
+				},
+			},
+		}},
+		{"cache {\n allow_set_cookie \n strip_header Set-Cookie X-Debug-* \n strip_header Server \n set_header X-Cache-Key {cache_key} \n}", false, Config{
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			KeepStale:        defaultKeepStale,
+			GCInterval:       defaultGCInterval,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			StatusHeader:     defaultStatusHeader,
+			AllowSetCookie:   true,
+			StripHeaders:     []string{"Set-Cookie", "X-Debug-*", "Server"},
+			SetHeaders:       http.Header{"X-Cache-Key": []string{"{cache_key}"}},
+		}},
+		{"cache {\n match_header aheader \n}", true, Config{}},                                 // match_header without value
+		{"cache {\n lock_timeout aheader \n}", true, Config{}},                                 // lock_timeout with invalid duration
+		{"cache {\n lock_timeout \n}", true, Config{}},                                         // lock_timeout has no arguments
+		{"cache {\n default_max_age somevalue \n}", true, Config{}},                            // lock_timeout has invalid duration
+		{"cache {\n default_max_age \n}", true, Config{}},                                      // default_max_age has no arguments
+		{"cache {\n status_header aheader another \n}", true, Config{}},                        // status_header with invalid number of parameters
+		{"cache {\n match_path / ea \n}", true, Config{}},                                      // Invalid number of parameters in match
+		{"cache {\n invalid / ea \n}", true, Config{}},                                         // Invalid directive
+		{"cache {\n path \n}", true, Config{}},                                                 // Path without arguments
+		{"cache {\n cache_key \n}", true, Config{}},                                            // cache_key without arguments
+		{"cache {\n keep_stale forever \n}", true, Config{}},                                   // keep_stale with invalid duration
+		{"cache {\n stale_while_revalidate \n}", true, Config{}},                               // stale_while_revalidate without arguments
+		{"cache {\n stale_if_error 1 \n}", true, Config{}},                                     // stale_if_error with invalid duration
+		{"cache {\n purge_method PURGE \n}", true, Config{}},                                   // purge_method without purge_allow or purge_secret
+		{"cache {\n purge_allow 10.0.0.300 \n}", true, Config{}},                               // purge_allow with invalid ip
+		{"cache {\n purge_secret X-Token \n}", true, Config{}},                                 // purge_secret without value
+		{"cache {\n tag_header \n}", true, Config{}},                                           // tag_header without arguments
+		{"cache {\n max_entries -1 \n}", true, Config{}},                                       // max_entries with negative number
+		{"cache {\n max_disk_size 10TB \n}", true, Config{}},                                   // max_disk_size with unknown unit
+		{"cache {\n max_memory_size \n}", true, Config{}},                                      // max_memory_size without arguments
+		{"cache {\n gc_interval often \n}", true, Config{}},                                    // gc_interval with invalid duration
+		{"cache {\n gc_rate_limit -5 \n}", true, Config{}},                                     // gc_rate_limit with negative number
+		{"cache {\n metrics_path \n}", true, Config{}},                                         // metrics_path without arguments
+		{"cache {\n admin_path /cache-admin \n}", true, Config{}},                              // admin_path without admin_allow or admin_secret
+		{"cache {\n admin_allow localhost \n}", true, Config{}},                                // admin_allow with invalid ip
+		{"cache {\n request_cache_control \n}", true, Config{}},                                // request_cache_control without arguments
+		{"cache {\n cache_status edge ttl \n}", true, Config{}},                                // cache_status with unknown option
+		{"cache {\n head_as_get yes \n}", true, Config{}},                                      // head_as_get with a value
+		{"cache {\n status_ttl 404 \n}", true, Config{}},                                       // status_ttl without duration
+		{"cache {\n status_ttl 6xx 1s \n}", true, Config{}},                                    // status_ttl with invalid class
+		{"cache {\n status_ttl 404 0s \n}", true, Config{}},                                    // status_ttl with zero duration
+		{"cache {\n key_sort_query yes \n}", true, Config{}},                                   // key_sort_query with a value
+		{"cache {\n key_ignore_params \n}", true, Config{}},                                    // key_ignore_params without params
+		{"cache {\n key_keep_params [id \n}", true, Config{}},                                  // key_keep_params with invalid glob
+		{"cache {\n bypass \n}", true, Config{}},                                               // bypass without name
+		{"cache {\n bypass a \n}", true, Config{}},                                             // bypass without block
+		{"cache {\n bypass a { \n } \n}", true, Config{}},                                      // bypass without conditions
+		{"cache {\n bypass a { \n user bob \n } \n}", true, Config{}},                          // bypass with unknown condition
+		{"cache {\n bypass a { \n ip localhost \n } \n}", true, Config{}},                      // bypass with invalid ip
+		{"cache {\n match_status ok \n}", true, Config{}},                                      // match_status with invalid status
+		{"cache {\n match_path_regex ( \n}", true, Config{}},                                   // match_path_regex with invalid regex
+		{"cache {\n match_content_length 2MB 1MB \n}", true, Config{}},                         // match_content_length with max lower than min
+		{"cache {\n match_all \n}", true, Config{}},                                            // match_all without block
+		{"cache {\n match_any { \n } \n}", true, Config{}},                                     // match_any without rules
+		{"cache {\n match_not { \n keep_stale 1h \n } \n}", true, Config{}},                    // match_not with other parameter
+		{"cache {\n rule { \n ttl 1h \n } \n}", true, Config{}},                                // rule without match rules
+		{"cache {\n rule { \n match_path / \n override public \n } \n}", true, Config{}},       // rule overriding an unknown directive
+		{"cache {\n rule { \n match_path / \n ttl 1h \n never_cache \n } \n}", true, Config{}}, // rule with ttl and never_cache
+		{"cache {\n rule { \n match_path / \n keep_stale 1h \n } \n}", true, Config{}},         // rule with other parameter
+		{"cache {\n allow_set_cookie yes \n}", true, Config{}},                                 // allow_set_cookie with a value
+		{"cache {\n strip_header \n}", true, Config{}},                                         // strip_header without headers
+		{"cache {\n set_header X-Cache \n}", true, Config{}},                                   // set_header without value
+		{"cache {\n storage redis \n}", true, Config{}},                                        // storage with unknown type
+		{"cache {\n storage disk 1MB \n}", true, Config{}},                                     // storage with max size for disk
 	}
 
 	for i, test := range tests {
@@ -112,3 +454,25 @@ func TestParsingConfig(t *testing.T) {
 	}
 
 }
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		input  string
+		expect int64
+	}{
+		{"100", 100},
+		{"100B", 100},
+		{"4kb", 4096},
+		{"10MB", 10 << 20},
+		{"1GB", 1 << 30},
+	}
+
+	for _, test := range tests {
+		size, err := parseSize(test.input)
+		require.NoError(t, err)
+		require.Equal(t, test.expect, size, "Invalid size parsed from "+test.input)
+	}
+
+	_, err := parseSize("MB")
+	require.Error(t, err)
+}
@@ -1,9 +1,18 @@
 package storage
 
 import (
+	"errors"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	filePrefix     = "caddy-cache-"
+	metadataSuffix = ".meta"
 )
 
 // FileStorage saves the content into a file
@@ -14,7 +23,7 @@ type FileStorage struct {
 
 // NewFileStorage creates a new temp file that will be used as a the storage of the cache entry
 func NewFileStorage(path string) (ResponseStorage, error) {
-	file, err := ioutil.TempFile(path, "caddy-cache-")
+	file, err := ioutil.TempFile(path, filePrefix)
 	if err != nil {
 		return nil, err
 	}
@@ -24,6 +33,22 @@ func NewFileStorage(path string) (ResponseStorage, error) {
 	}, nil
 }
 
+// OpenFileStorage opens a file saved by a previous FileStorage.
+// The storage is already closed so it can only be read
+func OpenFileStorage(name string) (*FileStorage, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &FileStorage{
+		file:         file,
+		subscription: NewSubscription(),
+	}
+	f.Close()
+	return f, nil
+}
+
 func (f *FileStorage) Write(p []byte) (n int, err error) {
 	defer f.subscription.NotifyAll(len(p))
 	return f.file.Write(p)
@@ -35,10 +60,37 @@ func (f *FileStorage) Flush() error {
 	return f.file.Sync()
 }
 
-// Clean removes the file
+// Clean removes the file and its metadata
 func (f *FileStorage) Clean() error {
 	f.subscription.WaitAll() // Wait until every subscriber ends waiting every result
-	return os.Remove(f.file.Name())
+	return RemoveFile(f.file.Name())
+}
+
+// Name returns the path of the underlying file
+func (f *FileStorage) Name() string {
+	return f.file.Name()
+}
+
+// SaveMetadata writes data to a file next to the content, replacing the previous one
+func (f *FileStorage) SaveMetadata(data []byte) error {
+	// The temporary name does not start with the file prefix so it is never listed
+	tmp, err := ioutil.TempFile(filepath.Dir(f.file.Name()), "."+filepath.Base(f.file.Name())+metadataSuffix)
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// Rename is atomic so a crash never leaves half written metadata
+		err = os.Rename(tmp.Name(), f.file.Name()+metadataSuffix)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
 }
 
 // Close the underlying file
@@ -47,6 +99,11 @@ func (f *FileStorage) Close() error {
 	return f.file.Close()
 }
 
+// HasReaders returns if there are readers that did not close yet
+func (f *FileStorage) HasReaders() bool {
+	return f.subscription.hasSubscribers()
+}
+
 // GetReader returns a new file descriptor to the same file
 func (f *FileStorage) GetReader() (io.ReadCloser, error) {
 	newFile, err := os.Open(f.file.Name())
@@ -62,6 +119,52 @@ func (f *FileStorage) GetReader() (io.ReadCloser, error) {
 
 /////////////////////////////////////////
 
+// StoredFile is a file left in a directory by a FileStorage
+type StoredFile struct {
+	Name     string
+	Size     int64
+	ModTime  time.Time
+	Metadata []byte // nil if the metadata was never saved
+}
+
+// ListFiles returns the files saved by FileStorages in path with their metadata
+func ListFiles(path string) ([]StoredFile, error) {
+	if path == "" {
+		path = os.TempDir()
+	}
+
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []StoredFile{}
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasPrefix(name, filePrefix) || strings.HasSuffix(name, metadataSuffix) {
+			continue
+		}
+
+		file := StoredFile{Name: filepath.Join(path, name), Size: info.Size(), ModTime: info.ModTime()}
+		metadata, err := ioutil.ReadFile(file.Name + metadataSuffix)
+		if err == nil {
+			file.Metadata = metadata
+		}
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+// RemoveFile removes a file saved by a FileStorage and its metadata
+func RemoveFile(name string) error {
+	err := os.Remove(name)
+	if metaErr := os.Remove(name + metadataSuffix); metaErr != nil && !os.IsNotExist(metaErr) && err == nil {
+		err = metaErr
+	}
+	return err
+}
+
 // FileReader is the common code to read the storages until the subscription channel is closed
 type FileReader struct {
 	subscription <-chan int
@@ -80,6 +183,16 @@ func (r *FileReader) Read(p []byte) (n int, err error) {
 	return r.content.Read(p)
 }
 
+// Seek changes the offset of the next Read. Reads after the end of what was
+// already written keep waiting for the new content like any other Read
+func (r *FileReader) Seek(offset int64, whence int) (int64, error) {
+	seeker, ok := r.content.(io.Seeker)
+	if !ok {
+		return 0, errors.New("Storage content is not seekable")
+	}
+	return seeker.Seek(offset, whence)
+}
+
 // Close closes the underlying storage
 func (r *FileReader) Close() error {
 	err := r.content.Close()
@@ -54,6 +54,50 @@ func TestFileStorage(t *testing.T) {
 	})
 }
 
+func TestStoredFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddy-cache-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	withMetadata, _ := NewFileStorage(dir)
+	withMetadata.Write([]byte("abc"))
+	withMetadata.Close()
+	require.NoError(t, withMetadata.(*FileStorage).SaveMetadata([]byte("{}")))
+
+	withoutMetadata, _ := NewFileStorage(dir)
+	withoutMetadata.Close()
+
+	files, err := ListFiles(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+
+	for _, file := range files {
+		if file.Name == withMetadata.(*FileStorage).Name() {
+			require.Equal(t, []byte("{}"), file.Metadata)
+			require.Equal(t, int64(3), file.Size)
+		} else {
+			require.Nil(t, file.Metadata)
+		}
+	}
+
+	opened, err := OpenFileStorage(withMetadata.(*FileStorage).Name())
+	require.NoError(t, err)
+	reader, _ := opened.GetReader()
+	content, _ := ioutil.ReadAll(reader)
+	reader.Close()
+	require.Equal(t, []byte("abc"), content)
+
+	require.NoError(t, opened.Clean())
+	withoutMetadata.Clean()
+
+	files, err = ListFiles(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 0)
+
+	remaining, _ := ioutil.ReadDir(dir)
+	require.Len(t, remaining, 0)
+}
+
 func TestFileReader(t *testing.T) {
 	t.Run("should ignore EOF until subscription is closed", func(t *testing.T) {
 		buf := new(bytes.Buffer)
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// MemoryStorage saves the content in memory
+type MemoryStorage struct {
+	content      []byte
+	contentLock  *sync.RWMutex
+	subscription *Subscription
+}
+
+// NewMemoryStorage creates a new empty storage that keeps the content in memory
+func NewMemoryStorage() ResponseStorage {
+	return &MemoryStorage{
+		contentLock:  new(sync.RWMutex),
+		subscription: NewSubscription(),
+	}
+}
+
+func (m *MemoryStorage) Write(p []byte) (n int, err error) {
+	defer m.subscription.NotifyAll(len(p))
+	m.contentLock.Lock()
+	defer m.contentLock.Unlock()
+	m.content = append(m.content, p...)
+	return len(p), nil
+}
+
+// Flush notifies the readers, the content is already available
+func (m *MemoryStorage) Flush() error {
+	m.subscription.NotifyAll(0)
+	return nil
+}
+
+// Clean releases the content
+func (m *MemoryStorage) Clean() error {
+	m.subscription.WaitAll() // Wait until every subscriber ends waiting every result
+	m.contentLock.Lock()
+	defer m.contentLock.Unlock()
+	m.content = nil
+	return nil
+}
+
+// Close means there will not be more writes
+func (m *MemoryStorage) Close() error {
+	m.subscription.Close()
+	return nil
+}
+
+// HasReaders returns if there are readers that did not close yet
+func (m *MemoryStorage) HasReaders() bool {
+	return m.subscription.hasSubscribers()
+}
+
+// GetReader returns a reader that starts at the beginning of the content
+func (m *MemoryStorage) GetReader() (io.ReadCloser, error) {
+	return &FileReader{
+		content:      &memoryCursor{storage: m},
+		subscription: m.subscription.NewSubscriber(),
+		unsubscribe:  m.subscription.RemoveSubscriber,
+	}, nil
+}
+
+// readAt copies the content starting at offset. It returns io.EOF
+// when there is nothing written after offset yet
+func (m *MemoryStorage) readAt(p []byte, offset int64) (int, error) {
+	m.contentLock.RLock()
+	defer m.contentLock.RUnlock()
+
+	if offset >= int64(len(m.content)) {
+		return 0, io.EOF
+	}
+	return copy(p, m.content[offset:]), nil
+}
+
+/////////////////////////////////////////
+
+// memoryCursor reads a MemoryStorage keeping its own offset
+type memoryCursor struct {
+	storage *MemoryStorage
+	offset  int64
+}
+
+func (c *memoryCursor) Read(p []byte) (int, error) {
+	n, err := c.storage.readAt(p, c.offset)
+	c.offset += int64(n)
+	return n, err
+}
+
+// Seek only supports offsets from the start or the current offset because
+// the end of the content is not known until the storage is closed
+func (c *memoryCursor) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += c.offset
+	default:
+		return c.offset, errors.New("Unsupported seek whence")
+	}
+
+	if offset < 0 {
+		return c.offset, errors.New("Negative offset")
+	}
+
+	c.offset = offset
+	return c.offset, nil
+}
+
+func (c *memoryCursor) Close() error {
+	return nil
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	t.Run("should be able to read after write", func(t *testing.T) {
+		s := NewMemoryStorage()
+		defer s.Clean()
+
+		reader, _ := s.GetReader()
+		defer reader.Close()
+
+		content := []byte("abcdef")
+		s.Write(content)
+
+		buf := make([]byte, 32*1024)
+		n, err := reader.Read(buf)
+
+		require.NoError(t, err)
+		require.Equal(t, content, buf[:n])
+	})
+
+	t.Run("should follow the content until it is closed", func(t *testing.T) {
+		s := NewMemoryStorage()
+		defer s.Clean()
+
+		reader, _ := s.GetReader()
+		defer reader.Close()
+
+		read := make(chan []byte)
+		go func() {
+			content, _ := ioutil.ReadAll(reader)
+			read <- content
+		}()
+
+		s.Write([]byte("abc"))
+		s.Write([]byte("def"))
+		s.Close()
+
+		require.Equal(t, []byte("abcdef"), <-read)
+	})
+
+	t.Run("should seek the content", func(t *testing.T) {
+		s := NewMemoryStorage()
+		defer s.Clean()
+
+		s.Write([]byte("abcdef"))
+		s.Close()
+
+		reader, _ := s.GetReader()
+		defer reader.Close()
+
+		_, err := reader.(io.Seeker).Seek(4, io.SeekStart)
+		require.NoError(t, err)
+
+		content, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, []byte("ef"), content)
+	})
+
+	t.Run("should release the content when is cleaned", func(t *testing.T) {
+		s := NewMemoryStorage()
+		s.Write([]byte("abcdef"))
+		s.Close()
+		s.Clean()
+
+		require.Nil(t, s.(*MemoryStorage).content)
+	})
+}
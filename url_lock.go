@@ -11,20 +11,24 @@ const urlLockBucketsSize = 256
 type URLLock struct {
 	globalLocks [urlLockBucketsSize]*sync.Mutex
 	keys        [urlLockBucketsSize]map[string]*sync.Mutex
+	refreshing  [urlLockBucketsSize]map[string]bool
 }
 
 func NewURLLock() *URLLock {
 	globalLocks := [urlLockBucketsSize]*sync.Mutex{}
 	keys := [urlLockBucketsSize]map[string]*sync.Mutex{}
+	refreshing := [urlLockBucketsSize]map[string]bool{}
 
 	for i := 0; i < int(urlLockBucketsSize); i++ {
 		globalLocks[i] = new(sync.Mutex)
 		keys[i] = make(map[string]*sync.Mutex)
+		refreshing[i] = make(map[string]bool)
 	}
 
 	return &URLLock{
 		globalLocks: globalLocks,
 		keys:        keys,
+		refreshing:  refreshing,
 	}
 }
 
@@ -43,6 +47,30 @@ func (allLocks *URLLock) Adquire(key string) *sync.Mutex {
 	return lock
 }
 
+// StartRefresh marks the key as being refreshed in background
+// It returns false without blocking if there is already a refresh for that key
+func (allLocks *URLLock) StartRefresh(key string) bool {
+	bucketIndex := allLocks.getBucketIndexForKey(key)
+	allLocks.globalLocks[bucketIndex].Lock()
+	defer allLocks.globalLocks[bucketIndex].Unlock()
+
+	if allLocks.refreshing[bucketIndex][key] {
+		return false
+	}
+
+	allLocks.refreshing[bucketIndex][key] = true
+	return true
+}
+
+// EndRefresh allows a new refresh for the key
+func (allLocks *URLLock) EndRefresh(key string) {
+	bucketIndex := allLocks.getBucketIndexForKey(key)
+	allLocks.globalLocks[bucketIndex].Lock()
+	defer allLocks.globalLocks[bucketIndex].Unlock()
+
+	delete(allLocks.refreshing[bucketIndex], key)
+}
+
 func (allLocks *URLLock) getBucketIndexForKey(key string) uint32 {
 	return uint32(math.Mod(float64(crc32.ChecksumIEEE([]byte(key))), float64(urlLockBucketsSize)))
 }